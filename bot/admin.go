@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const maxDebugDumpSize = 1000
+
+// adminCommands are handled by the bot and may only be used by bot.admins.
+var adminCommands = []string{"call", "debug", "maintenance"}
+
+var serviceRegex = regexp.MustCompile(`^[a-z0-9_]+\.[a-z0-9_]+$`)
+
+func (b *Bot) isAdmin(actor MessageActor) bool {
+	return slices.Contains(b.config.GetStringSlice("bot.admins"), actor.Id)
+}
+
+// debugParameters renders the rich object parameters of a message for the debug command.
+func debugParameters(parameters RichObjectParameters) string {
+	if len(parameters) == 0 {
+		return "No parameters"
+	}
+
+	dump, _ := json.Marshal(parameters)
+	if runes := []rune(string(dump)); len(runes) > maxDebugDumpSize {
+		return string(runes[:maxDebugDumpSize]) + "… (truncated)"
+	}
+
+	return string(dump)
+}
+
+// serviceCommandReply calls the service given as "@ha call domain.service" with
+// the named arguments as service data and returns the reply. "entity" is
+// accepted as short form of "entity_id".
+func (b *Bot) serviceCommandReply(ctx context.Context, command Command) string {
+	if b.config.GetString("bot.target_type") != "ha_rest" || b.config.GetString("bot.ha.token") == "" {
+		return "call is only available with target_type ha_rest and a token"
+	}
+	if len(command.Args) != 1 || !serviceRegex.MatchString(command.Args[0]) {
+		return "Usage: call domain.service key=value ..."
+	}
+	service := command.Args[0]
+
+	domain, _, _ := strings.Cut(service, ".")
+	if err := b.checkDomains(append(b.commandDomains(Command{Named: command.Named}), domain)); err != nil {
+		return "Error: " + err.Error()
+	}
+
+	data := make(map[string]any, len(command.Named))
+	for key, value := range command.Named {
+		if key == "entity" {
+			key = "entity_id"
+		}
+		data[key] = value
+	}
+
+	if b.dryRun {
+		request, payload, err := b.newServiceRequest(ctx, service, data)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return fmt.Sprintf("Would send: %s %s %s", request.Method, request.URL, payload)
+	}
+
+	responseBody, err := b.callService(ctx, service, data)
+	if err != nil {
+		return "Error calling " + service
+	}
+
+	return serviceSummary(service, responseBody)
+}
+
+// handleBuiltinCommand handles the commands implemented by the bot itself and
+// reports whether the command was one of them.
+func (b *Bot) handleBuiltinCommand(ctx context.Context, job commandJob, command Command) bool {
+	if !slices.Contains(adminCommands, command.Name) {
+		return false
+	}
+
+	if !b.isAdmin(job.message.Actor) {
+		log.Printf("[Admin]         %s is not allowed to use %s", job.message.Actor.Id, command.Name)
+		b.sendReply(ctx, job.server, job.message, "You are not allowed to use this command")
+		return true
+	}
+
+	switch command.Name {
+	case "call":
+		b.sendReply(ctx, job.server, job.message, b.serviceCommandReply(ctx, command))
+	case "debug":
+		b.sendReply(ctx, job.server, job.message, debugParameters(job.richMessage.Parameters))
+	case "maintenance":
+		state := ""
+		if len(command.Args) > 0 {
+			state = command.Args[0]
+		}
+
+		switch state {
+		case "on":
+			b.maintenanceMode.Store(true)
+		case "off":
+			b.maintenanceMode.Store(false)
+		case "status":
+		default:
+			b.sendReply(ctx, job.server, job.message, "Usage: maintenance on|off|status")
+			return true
+		}
+
+		if b.maintenanceMode.Load() {
+			log.Printf("[Admin]         Maintenance mode is on (%s)", job.message.Actor.Id)
+			b.sendReply(ctx, job.server, job.message, "Maintenance mode is on")
+		} else {
+			log.Printf("[Admin]         Maintenance mode is off (%s)", job.message.Actor.Id)
+			b.sendReply(ctx, job.server, job.message, "Maintenance mode is off")
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServiceCommandDryRun(t *testing.T) {
+	server, received := newTestHomeAssistant(t, http.StatusOK)
+	b := newTestBot(t, map[string]any{
+		"bot.ha.url":      server.URL,
+		"bot.ha.token":    "token",
+		"bot.target_type": "ha_rest",
+	}, WithDryRun())
+
+	reply := b.serviceCommandReply(context.Background(), Command{Name: "call", Args: []string{"light.turn_on"}, Named: map[string]string{"entity": "light.kitchen"}})
+	want := "Would send: POST " + server.URL + "/api/services/light/turn_on " + `{"entity_id":"light.kitchen"}`
+	if reply != want {
+		t.Errorf("reply = %q, want %q", reply, want)
+	}
+	if len(received) > 0 {
+		t.Errorf("%d requests to Home Assistant, want none", len(received))
+	}
+
+	// Without dry run the service is called
+	b = newTestBot(t, map[string]any{
+		"bot.ha.url":      server.URL,
+		"bot.ha.token":    "token",
+		"bot.target_type": "ha_rest",
+	})
+	if reply := b.serviceCommandReply(context.Background(), Command{Name: "call", Args: []string{"light.turn_on"}}); strings.HasPrefix(reply, "Would send") {
+		t.Errorf("reply = %q, want the service to be called", reply)
+	}
+	if len(received) != 1 {
+		t.Errorf("%d requests to Home Assistant, want 1", len(received))
+	}
+}
@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var argumentKeyRegex = regexp.MustCompile(`^\w+$`)
+
+// argument is a single word of a command. Named arguments are written as
+// key=value.
+type argument struct {
+	text  string
+	key   string
+	named bool
+}
+
+// splitArguments splits a command at whitespace. Double quotes group several
+// words into one argument and \" writes a quote inside them. An argument with
+// an "=" outside of quotes is named, so key="a b" is named while "key=a b" is
+// positional.
+func splitArguments(input string) ([]argument, error) {
+	var arguments []argument
+	var current strings.Builder
+	inQuotes, inArgument := false, false
+	equals := -1
+
+	flush := func() {
+		text := current.String()
+		if equals > 0 && argumentKeyRegex.MatchString(text[:equals]) {
+			arguments = append(arguments, argument{text: text[equals+1:], key: text[:equals], named: true})
+		} else {
+			arguments = append(arguments, argument{text: text})
+		}
+		current.Reset()
+		inArgument = false
+		equals = -1
+	}
+
+	runes := []rune(input)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case inQuotes && r == '\\' && i+1 < len(runes) && runes[i+1] == '"':
+			current.WriteRune('"')
+			i++
+		case r == '"':
+			inQuotes = !inQuotes
+			inArgument = true
+		case !inQuotes && unicode.IsSpace(r):
+			if inArgument {
+				flush()
+			}
+		case !inQuotes && r == '=' && equals < 0:
+			equals = current.Len()
+			current.WriteRune(r)
+			inArgument = true
+		default:
+			current.WriteRune(r)
+			inArgument = true
+		}
+	}
+
+	if inQuotes {
+		return nil, errors.New("missing closing quote")
+	}
+	if inArgument {
+		flush()
+	}
+
+	return arguments, nil
+}
+
+// parseArguments separates positional and named arguments. A key may only be
+// given once.
+func parseArguments(input string) (positional []string, named map[string]string, err error) {
+	arguments, err := splitArguments(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	named = make(map[string]string)
+	for _, arg := range arguments {
+		if !arg.named {
+			positional = append(positional, arg.text)
+			continue
+		}
+		if _, exists := named[arg.key]; exists {
+			return nil, nil, fmt.Errorf("argument %s is given more than once", arg.key)
+		}
+		named[arg.key] = arg.text
+	}
+
+	return positional, named, nil
+}
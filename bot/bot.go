@@ -0,0 +1,854 @@
+// Package bot implements a Nextcloud Talk bot forwarding chat commands to Home
+// Assistant: signature verification, message parsing, command dispatch and
+// signed replies. Create a Bot with New and serve its Handler.
+package bot
+
+// A sample bot sending welcoming messages as answer to "hello" and "good morning" chat messages
+//
+// Copyright (C) 2023Joas Schilling <coding@schilljs.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const maxWebhookResponseSize = 1 << 20
+
+// bareCommands are built-in commands which take no arguments, while all other
+// commands need at least one.
+var bareCommands = []string{"help", "ping", "retry", "vars"}
+
+var (
+	// ErrInvalidBody is returned when a request body can't be decoded.
+	ErrInvalidBody = errors.New("Invalid body supplied")
+	errNotCommand  = errors.New("message is not a command")
+	letterBytes    = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// Bot verifies requests from Nextcloud Talk, dispatches the commands they
+// contain to a Target and replies with the outcome. Create it with New.
+type Bot struct {
+	config              *viper.Viper
+	commandAliases      map[string]string
+	payloadTemplates    map[string]*template.Template
+	responseTemplates   map[string]*template.Template
+	argPatterns         map[string][]*regexp.Regexp
+	triggerPrefix       string
+	triggerMessageRegex *regexp.Regexp
+	store               Store
+	target              Target
+	webhookClient       *http.Client
+	replyClient         *http.Client
+	commandQueue        chan commandJob
+	// maintenanceMode stops commands from being sent to Home Assistant. It can
+	// be toggled at runtime by admins with "@ha maintenance on|off".
+	maintenanceMode  atomic.Bool
+	startWorkersOnce sync.Once
+	conversations    conversations
+	pendingReplies   pendingReplies
+	rateLimiter      rateLimiter
+	workers          sync.WaitGroup
+	captureMu        sync.Mutex
+	// dryRun makes the admin command call reply with the request it would
+	// send instead of sending it.
+	dryRun bool
+}
+
+// Option customizes a Bot created by New.
+type Option func(*Bot)
+
+// WithStore replaces the store configured by bot.redis.url.
+func WithStore(store Store) Option {
+	return func(b *Bot) {
+		b.store = store
+	}
+}
+
+// WithTarget replaces the target configured by bot.target_type.
+func WithTarget(target Target) Option {
+	return func(b *Bot) {
+		b.target = target
+	}
+}
+
+// WithDryRun keeps the admin command call from calling Home Assistant. The
+// other commands are sent to the target, which WithTarget can replace.
+func WithDryRun() Option {
+	return func(b *Bot) {
+		b.dryRun = true
+	}
+}
+
+// WithWebhookClient replaces the HTTP client used to call Home Assistant.
+func WithWebhookClient(client *http.Client) Option {
+	return func(b *Bot) {
+		b.webhookClient = client
+	}
+}
+
+// New creates a bot from a config with defaults registered by SetDefaults.
+// The config is validated, secrets configured as files are read into it, and
+// it must not be modified afterwards.
+func New(cfg *viper.Viper, options ...Option) (*Bot, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, fmt.Errorf("config values: %w", err)
+	}
+	if err := resolveSecretFiles(cfg); err != nil {
+		return nil, fmt.Errorf("secret files: %w", err)
+	}
+
+	b := &Bot{
+		config: cfg,
+		replyClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+	for _, option := range options {
+		option(b)
+	}
+
+	aliases, err := b.buildCommandAliases()
+	if err != nil {
+		return nil, fmt.Errorf("command aliases: %w", err)
+	}
+	b.commandAliases = aliases
+
+	templates, err := b.buildPayloadTemplates()
+	if err != nil {
+		return nil, fmt.Errorf("payload templates: %w", err)
+	}
+	b.payloadTemplates = templates
+
+	responseTemplates, err := b.buildResponseTemplates()
+	if err != nil {
+		return nil, fmt.Errorf("response templates: %w", err)
+	}
+	b.responseTemplates = responseTemplates
+
+	patterns, err := b.buildArgPatterns()
+	if err != nil {
+		return nil, fmt.Errorf("argument patterns: %w", err)
+	}
+	b.argPatterns = patterns
+
+	b.triggerPrefix = cfg.GetString("bot.trigger")
+	if b.triggerMessageRegex, err = buildTriggerRegex(b.triggerPrefix); err != nil {
+		return nil, fmt.Errorf("bot.trigger: %w", err)
+	}
+
+	if b.store == nil {
+		if b.store, err = b.newStore(); err != nil {
+			return nil, fmt.Errorf("store: %w", err)
+		}
+		if cfg.GetString("bot.redis.url") != "" {
+			log.Println("[Config]        Sharing replay and dedupe state via Redis")
+		}
+	}
+
+	if b.target == nil {
+		if b.target, err = b.newTarget(cfg.GetString("bot.target_type")); err != nil {
+			return nil, fmt.Errorf("target: %w", err)
+		}
+	}
+
+	if b.webhookClient == nil {
+		b.webhookClient = b.newWebhookClient()
+	}
+
+	if cfg.GetString("bot.secret") == "" {
+		log.Println("[Config]        WARNING: bot.secret is empty, requests signed without a secret are accepted")
+	}
+	if cfg.GetBool("bot.dev_skip_signature") {
+		log.Println("[Config]        WARNING: bot.dev_skip_signature is enabled, loopback requests are not verified")
+	}
+
+	if err := b.loadVars(); err != nil {
+		return nil, fmt.Errorf("vars file: %w", err)
+	}
+
+	b.maintenanceMode.Store(cfg.GetBool("bot.maintenance"))
+	if b.maintenanceMode.Load() {
+		log.Println("[Config]        Maintenance mode is active, commands are not sent to Home Assistant")
+	}
+
+	return b, nil
+}
+
+// Handler returns the HTTP handler receiving messages from Talk on /message.
+// The workers processing commands are started with the first call.
+func (b *Bot) Handler() http.Handler {
+	b.startWorkersOnce.Do(func() {
+		b.startWorkers(b.config.GetInt("bot.workers"), b.config.GetInt("bot.queue_size"))
+	})
+
+	// Create a mux for routing incoming requests
+	m := http.NewServeMux()
+
+	// All URLs will be handled by this function
+	m.HandleFunc("/message", b.messageHandling)
+
+	return recoverPanics(m)
+}
+
+// recoverPanics answers 500 when a handler panics and logs the panic with its
+// stack trace, instead of dropping the connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("[Request]       PANIC handling %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Preview parses a chat message like the handler does and returns the request
+// the target would send for it, without sending it.
+func (b *Bot) Preview(text string) (*http.Request, []byte, error) {
+	if !b.isCommand(text) {
+		return nil, nil, fmt.Errorf("message is not a command (trigger %q)", b.triggerPrefix)
+	}
+
+	command, err := b.ParseCommand(text)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := b.validateArgs(command); err != nil {
+		return nil, nil, err
+	}
+
+	// Build a Talk request body for raw forwarding
+	content, _ := json.Marshal(RichObjectMessage{Message: text})
+	command.Raw, _ = json.Marshal(Message{
+		Type:   "Create",
+		Actor:  MessageActor{Type: "Person", Id: "users/test", Name: "Test"},
+		Object: MessageObject{Type: "Note", Id: "1", Name: "message", Content: string(content), MediaType: "text/markdown"},
+		Target: MessageTarget{Type: "Collection", Id: "test", Name: "Test"},
+	})
+
+	preview, ok := b.target.(previewer)
+	if !ok {
+		return nil, nil, fmt.Errorf("target %T can't be previewed", b.target)
+	}
+
+	return preview.Preview(command)
+}
+
+// Command is a trigger message with the prefix stripped.
+type Command struct {
+	Prefix string
+	Name   string
+	Args   []string
+	Named  map[string]string
+	// Vars are the vars set in the conversation with "@ha set"
+	Vars map[string]string
+	// Text is the whole message and Raw the Talk request body it was sent in
+	Text string
+	Raw  []byte
+}
+
+// MessageActor is the author of a message. Id is prefixed with the actor type,
+// e.g. "users/alice" or "guests/…".
+type MessageActor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// TalkParticipantType is the participant type in the conversation, e.g.
+	// "1" for the owner; only sent by Talk 18 and later
+	TalkParticipantType string `json:"talkParticipantType,omitempty"`
+}
+
+// MessageObject is the message itself. Content holds the JSON encoded
+// RichObjectMessageWithParameters.
+type MessageObject struct {
+	Type      string `json:"type"`
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Content   string `json:"content"`
+	MediaType string `json:"mediaType"`
+	// InReplyTo is the message replied to, in the same format; only sent for
+	// replies by Talk 19 and later
+	InReplyTo *MessageObject `json:"inReplyTo,omitempty"`
+}
+
+// MessageTarget is the conversation, Id being its token.
+type MessageTarget struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Message is the activity Talk sends to the bot. Fields which are not known
+// here are ignored, so newer Talk versions can add them.
+type Message struct {
+	// Id and Published identify the activity and when it happened, if Talk
+	// sends them
+	Id        string        `json:"id,omitempty"`
+	Published string        `json:"published,omitempty"`
+	Type      string        `json:"type"`
+	Actor     MessageActor  `json:"actor"`
+	Object    MessageObject `json:"object"`
+	Target    MessageTarget `json:"target"`
+}
+
+type Response struct {
+	Message string `json:"message"`
+	ReplyTo string `json:"replyTo"`
+	// Silent messages don't notify the participants of the conversation
+	Silent bool `json:"silent,omitempty"`
+}
+
+type RichObjectParameter struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type RichObjectMessage struct {
+	Message string `json:"message"`
+}
+
+// RichObjectParameters maps placeholders like "mention-user1" to their objects.
+// Talk sends an empty JSON array instead of an object when there are none.
+type RichObjectParameters map[string]RichObjectParameter
+
+func (p *RichObjectParameters) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "[]" {
+		*p = nil
+		return nil
+	}
+
+	return json.Unmarshal(data, (*map[string]RichObjectParameter)(p))
+}
+
+type RichObjectMessageWithParameters struct {
+	RichObjectMessage
+	Parameters RichObjectParameters `json:"parameters,omitempty"`
+}
+
+// decodeStrict decodes a single JSON value and rejects anything but whitespace after it.
+func decodeStrict(input string, v any) error {
+	reader := strings.NewReader(input)
+	decoder := json.NewDecoder(reader)
+	if err := decoder.Decode(v); err != nil {
+		return ErrInvalidBody
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return ErrInvalidBody
+	}
+
+	return nil
+}
+
+func createMessage(input string) (Message, error) {
+	var message Message
+	err := decodeStrict(input, &message)
+	return message, err
+}
+
+// unwrapContent undoes one extra level of JSON encoding, as some Talk versions
+// send the message content as a JSON string containing the encoded object.
+// Only a single level is removed, so the object is decoded at most twice.
+func unwrapContent(input string) string {
+	var encoded string
+	if err := json.Unmarshal([]byte(input), &encoded); err != nil {
+		return input
+	}
+
+	return encoded
+}
+
+func createRichMessage(input string) (RichObjectMessageWithParameters, error) {
+	var message RichObjectMessageWithParameters
+	err := decodeStrict(unwrapContent(input), &message)
+	return message, err
+}
+
+// buildTriggerRegex matches messages starting with the trigger prefix followed
+// by a command and an argument.
+func buildTriggerRegex(prefix string) (*regexp.Regexp, error) {
+	pattern := "^" + regexp.QuoteMeta(prefix) + "\\s+\\w+\\s+\\S"
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	return regex, nil
+}
+
+func generateRandomBytes(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return string(b)
+}
+
+func (b *Bot) getRandomResponse() string {
+	possibleResponses := b.config.GetStringSlice("bot.responses")
+	if len(possibleResponses) == 0 {
+		return defaultResponse
+	}
+
+	return possibleResponses[rand.Intn(len(possibleResponses))]
+}
+
+func GenerateHmacForString(message string, random string, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(random + message))
+	sum := h.Sum(nil)
+	return hex.EncodeToString(sum)
+}
+
+// mentionActor prefixes the reply with a mention of the user who sent the message.
+// Talk describes user mentions as a "{mention-user1}" placeholder with a
+// parameter of type "user", holding the user id and display name.
+func mentionActor(message Message, text string) RichObjectMessageWithParameters {
+	userId, isUser := strings.CutPrefix(message.Actor.Id, "users/")
+	if !isUser {
+		return RichObjectMessageWithParameters{RichObjectMessage: RichObjectMessage{Message: text}}
+	}
+
+	return RichObjectMessageWithParameters{
+		RichObjectMessage: RichObjectMessage{Message: "{mention-user1} " + text},
+		Parameters: map[string]RichObjectParameter{
+			"mention-user1": {Id: userId, Name: message.Actor.Name, Type: "user"},
+		},
+	}
+}
+
+// richMessageToText replaces mention placeholders with the @"id" syntax, as the
+// bot API only accepts plain text and parses mentions itself.
+func richMessageToText(message RichObjectMessageWithParameters) string {
+	text := message.Message
+	for key, parameter := range message.Parameters {
+		if parameter.Type == "user" {
+			text = strings.ReplaceAll(text, "{"+key+"}", "@\""+parameter.Id+"\"")
+		}
+	}
+
+	return text
+}
+
+// responseFields names the fields of a reply as set in bot.response_fields,
+// which default to the field names of Response used by current Talk versions.
+func (b *Bot) responseFields(response Response) map[string]any {
+	fields := map[string]any{
+		b.config.GetString("bot.response_fields.message"):  response.Message,
+		b.config.GetString("bot.response_fields.reply_to"): response.ReplyTo,
+	}
+	if response.Silent {
+		fields[b.config.GetString("bot.response_fields.silent")] = true
+	}
+
+	return fields
+}
+
+func (b *Bot) sendReply(ctx context.Context, server string, message Message, responseText string) {
+	if b.config.GetBool("bot.mention_actor") {
+		responseText = richMessageToText(mentionActor(message, responseText))
+	}
+
+	random := generateRandomBytes(b.config.GetInt("bot.nonce_length"))
+	signature := GenerateHmacForString(responseText, random, b.config.GetString("bot.secret"))
+
+	// Send actual message
+	response := Response{
+		Message: responseText,
+		ReplyTo: message.Object.Id,
+		Silent:  b.config.GetString("bot.reply_message_type") == "silent",
+	}
+	responseBody, _ := json.Marshal(b.responseFields(response))
+	requestURL := server + strings.ReplaceAll(b.config.GetString("bot.api_path"), "{token}", message.Target.Id)
+
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewReader(responseBody))
+		if err != nil {
+			log.Printf("[Response]      Error creating request %v", err)
+			return
+		}
+
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("OCS-APIRequest", "true")
+		request.Header.Set("X-Nextcloud-Talk-Bot-Random", random)
+		request.Header.Set("X-Nextcloud-Talk-Bot-Signature", signature)
+
+		resp, err := b.replyClient.Do(request)
+		if err != nil {
+			log.Printf("[Response]      Error posting request %v", err)
+			return
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return
+		case resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusPreconditionFailed:
+			// Talk already has this message, retrying would post it twice
+			log.Printf("[Response]      Talk answered %d, treating message as delivered", resp.StatusCode)
+			return
+		case resp.StatusCode == http.StatusTooManyRequests && attempt < b.config.GetInt("bot.reply_max_retries"):
+			wait := retryAfter(resp.Header.Get("Retry-After"), b.config.GetDuration("bot.reply_max_retry_after"))
+			log.Printf("[Response]      Talk is rate limiting, retrying in %s", wait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				log.Printf("[Response]      Giving up retrying: %s", ctx.Err())
+				return
+			}
+		default:
+			log.Printf("[Response]      Error posting request, status code %d", resp.StatusCode)
+			return
+		}
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds or as HTTP date. The
+// wait is at least a second and at most limit.
+func retryAfter(value string, limit time.Duration) time.Duration {
+	wait := time.Second
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	}
+
+	return min(max(wait, time.Second), limit)
+}
+
+// isLoopbackRequest reports whether the request was made from a loopback address.
+// Only the connection address is trusted, forwarding headers are ignored.
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (b *Bot) messageHandling(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	if r.Method != http.MethodPost {
+		// Only post allowed
+		return
+	}
+
+	if b.config.GetBool("bot.require_json_content_type") {
+		contentType := r.Header.Get("Content-Type")
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			log.Printf("[Request]       Error unsupported content type %q from %s", contentType, r.RemoteAddr)
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("[Request]       Error reading body: %v", err)
+		http.Error(w, "can't read body", http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// Usually a health check or probe, not worth validating
+		log.Printf("[Request]       Error empty body from %s", r.RemoteAddr)
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	server := r.Header.Get(b.config.GetString("bot.headers.backend"))
+	random := r.Header.Get(b.config.GetString("bot.headers.random"))
+	signature := r.Header.Get(b.config.GetString("bot.headers.signature"))
+	digest := GenerateHmacForString(string(body), random, b.config.GetString("bot.secret"))
+
+	if b.config.GetBool("bot.dev_skip_signature") && isLoopbackRequest(r) {
+		log.Printf("[Request]       WARNING: Skipping signature validation for loopback request from %s (bot.dev_skip_signature)", r.RemoteAddr)
+	} else if digest != signature {
+		log.Printf("[Request]       Error validating signature: %s / %s", digest, signature)
+		log.Printf("[Request]       Headers present: %s", strings.Join(headerNames(r.Header), ", "))
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	} else if window := b.config.GetDuration("bot.replay_window"); window > 0 {
+		// A signed request must never be accepted twice
+		replayed, err := b.store.Seen(r.Context(), "random:"+random, window)
+		if err != nil {
+			log.Printf("[Request]       Error checking for replay: %s", err)
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if replayed {
+			log.Printf("[Request]       WARNING: Rejecting replayed request from %s", r.RemoteAddr)
+			http.Error(w, "Replayed request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := b.captureRequest(r, body); err != nil {
+		log.Printf("[Request]       Error capturing request: %s", err)
+	}
+
+	message, err := createMessage(string(body))
+
+	if err != nil {
+		log.Printf("[Request]       Error invalid body: %s", err)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+
+	if message.Target.Id == "" {
+		// Replies are posted to the conversation, so there is nowhere to answer
+		log.Printf("[Request]       Error invalid body: missing conversation token (target.id), skipping message")
+		http.Error(w, "Missing target", http.StatusBadRequest)
+		return
+	}
+
+	dedupeKey := ""
+	if window := b.config.GetDuration("bot.dedupe_window"); window > 0 && message.Object.Id != "" {
+		dedupeKey = "message:" + message.Target.Id + ":" + message.Object.Id
+		duplicate, err := b.store.Seen(r.Context(), dedupeKey, window)
+		if err != nil {
+			// Handling a message twice is better than dropping it
+			log.Printf("[Request]       Error checking for duplicate: %s", err)
+		} else if duplicate {
+			log.Printf("[Talk]          Ignoring duplicate message %s in %s", message.Object.Id, message.Target.Id)
+			http.Error(w, "Received", http.StatusOK)
+			return
+		}
+	}
+
+	if allowed := b.config.GetStringSlice("bot.allowed_conversations"); len(allowed) > 0 && !slices.Contains(allowed, message.Target.Id) {
+		log.Printf("[Talk]          WARNING: Ignoring message from conversation %s (%s) which is not allowed", message.Target.Id, message.Target.Name)
+		http.Error(w, "Received", http.StatusOK)
+		return
+	}
+
+	if message.Object.Name == "message" {
+		richMessage, err := createRichMessage(message.Object.Content)
+		if err == nil && b.isIgnored(richMessage.Message) {
+			// Meant for another bot, not even worth a log line
+			http.Error(w, "Received", http.StatusOK)
+			return
+		}
+		if err == nil {
+			if b.isCommand(richMessage.Message) {
+				log.Printf("[Talk]          Command found: %s", richMessage.Message)
+
+				if !b.allowCommand(message.Target.Id) {
+					log.Printf("[Talk]          WARNING: Rate limit of %s exceeded, dropping command: %s", message.Target.Id, richMessage.Message)
+					b.forgetMessage(r.Context(), dedupeKey)
+					http.Error(w, "Too many commands", http.StatusTooManyRequests)
+					return
+				}
+
+				// Errors are replied by the worker, like all other outcomes
+				command, parseErr := b.ParseCommand(richMessage.Message)
+				command.Raw = body
+
+				// Home Assistant is called by a worker, so Talk gets its answer right away
+				if !b.enqueueCommand(commandJob{server: server, message: message, richMessage: richMessage, command: command, parseErr: parseErr, received: received}) {
+					log.Printf("[Talk]          Queue is full, dropping command: %s", richMessage.Message)
+					b.forgetMessage(r.Context(), dedupeKey)
+					http.Error(w, "Busy", http.StatusServiceUnavailable)
+					return
+				}
+
+			} else if b.config.GetBool("bot.reply_on_bare_mention") && b.isMentioned(richMessage.Message) {
+				log.Printf("[Talk]          Bot mentioned without command: %s", richMessage.Message)
+				// Talk gets no error for a mention, it is just not answered
+				if !b.allowCommand(message.Target.Id) {
+					log.Printf("[Talk]          WARNING: Rate limit of %s exceeded, not replying to mention: %s", message.Target.Id, richMessage.Message)
+				} else if !b.enqueueCommand(commandJob{server: server, message: message, richMessage: richMessage, bareMention: true, received: received}) {
+					log.Printf("[Talk]          Queue is full, dropping mention: %s", richMessage.Message)
+				}
+			} else {
+				log.Printf("[Talk]          Message is not command: %s", richMessage.Message)
+			}
+		}
+	}
+
+	http.Error(w, "Received", http.StatusOK)
+}
+
+// forgetMessage removes the dedupe key of a message which was rejected, so
+// Talk delivering it again is not dropped as duplicate.
+func (b *Bot) forgetMessage(ctx context.Context, dedupeKey string) {
+	if dedupeKey == "" {
+		return
+	}
+
+	if err := b.store.Forget(ctx, dedupeKey); err != nil {
+		log.Printf("[Request]       Error forgetting message: %s", err)
+	}
+}
+
+// headerNames returns the sorted names of headers, without their values which
+// may be secret.
+func headerNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// isIgnored reports whether a message starts with one of bot.ignore_prefixes,
+// ignoring surrounding whitespace.
+func (b *Bot) isIgnored(text string) bool {
+	text = strings.TrimSpace(text)
+	for _, prefix := range b.config.GetStringSlice("bot.ignore_prefixes") {
+		if prefix != "" && strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isBuiltinCommand reports whether a command is handled by the bot itself.
+func isBuiltinCommand(name string) bool {
+	return slices.Contains(bareCommands, name) || slices.Contains(varCommands, name) || slices.Contains(adminCommands, name)
+}
+
+// buildCommandAliases maps every command configured in bot.commands and each of
+// its aliases to the command name. An alias claimed by two commands, or a name
+// of a built-in command, is an error.
+func (b *Bot) buildCommandAliases() (map[string]string, error) {
+	commands := b.config.GetStringMap("bot.commands")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	aliases := make(map[string]string)
+	for _, name := range names {
+		if isBuiltinCommand(name) {
+			return nil, fmt.Errorf("command %q is already used by a built-in command", name)
+		}
+		aliases[name] = name
+	}
+
+	for _, name := range names {
+		for _, alias := range b.config.GetStringSlice("bot.commands." + name + ".aliases") {
+			alias = strings.ToLower(alias)
+			if isBuiltinCommand(alias) {
+				return nil, fmt.Errorf("alias %q of command %q is already used by a built-in command", alias, name)
+			}
+			if other, ok := aliases[alias]; ok && other != name {
+				return nil, fmt.Errorf("alias %q of command %q is already used by command %q", alias, name, other)
+			}
+			aliases[alias] = name
+		}
+	}
+
+	return aliases, nil
+}
+
+// resolveCommand returns the command name for a word, or the word itself if it
+// isn't a configured command or alias. Built-in commands are matched ignoring
+// case, so their name is returned lower-cased.
+func (b *Bot) resolveCommand(word string) string {
+	if name, ok := b.commandAliases[strings.ToLower(word)]; ok {
+		return name
+	}
+	if isBuiltinCommand(strings.ToLower(word)) {
+		return strings.ToLower(word)
+	}
+
+	return word
+}
+
+// isCommand reports whether a message starts with the trigger followed by a
+// command with arguments, or by one of the bareCommands.
+func (b *Bot) isCommand(text string) bool {
+	if b.triggerMessageRegex.MatchString(text) {
+		return true
+	}
+
+	rest, found := strings.CutPrefix(strings.TrimSpace(text), b.triggerPrefix)
+	words := strings.Fields(rest)
+	return found && rest != strings.TrimLeft(rest, " \t\n") && len(words) == 1 && slices.Contains(bareCommands, strings.ToLower(words[0]))
+}
+
+// isMentioned reports whether a message addresses the bot by starting with the
+// trigger as a word of its own, e.g. "@ha" or "@ha what can you do?".
+func (b *Bot) isMentioned(text string) bool {
+	rest, found := strings.CutPrefix(strings.TrimSpace(text), b.triggerPrefix)
+	return found && (rest == "" || rest != strings.TrimLeft(rest, " \t\n"))
+}
+
+// ParseCommand strips the trigger prefix from a message and splits the rest into
+// the command name, its positional arguments and its key=value arguments. The
+// prefix may contain several words.
+func (b *Bot) ParseCommand(text string) (Command, error) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(text), b.triggerPrefix)
+	if !found {
+		return Command{}, errNotCommand
+	}
+
+	words, named, err := parseArguments(rest)
+	if err != nil {
+		return Command{}, err
+	}
+	if len(words) < 1 || (len(words)+len(named) < 2 && !slices.Contains(bareCommands, strings.ToLower(words[0]))) {
+		return Command{}, errNotCommand
+	}
+
+	return Command{
+		Prefix: b.triggerPrefix,
+		Name:   b.resolveCommand(words[0]),
+		Args:   words[1:],
+		Named:  named,
+		Text:   text,
+	}, nil
+}
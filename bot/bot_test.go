@@ -0,0 +1,391 @@
+package bot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testSecret = "test-secret"
+
+// newTestConfig returns a config with defaults and the given settings.
+func newTestConfig(settings map[string]any) *viper.Viper {
+	cfg := viper.New()
+	SetDefaults(cfg)
+	cfg.Set("bot.secret", testSecret)
+	cfg.Set("bot.ha.url", "http://homeassistant.invalid")
+	cfg.Set("bot.ha.webhook_id", "webhook")
+	for key, value := range settings {
+		cfg.Set(key, value)
+	}
+
+	return cfg
+}
+
+// newTestBot creates a bot from newTestConfig.
+func newTestBot(t *testing.T, settings map[string]any, options ...Option) *Bot {
+	t.Helper()
+
+	b, err := New(newTestConfig(settings), options...)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	return b
+}
+
+// talkBody returns the request body Talk sends for a chat message.
+func talkBody(text string) string {
+	content, _ := json.Marshal(RichObjectMessage{Message: text})
+	body, _ := json.Marshal(Message{
+		Type:   "Create",
+		Actor:  MessageActor{Type: "Person", Id: "users/alice", Name: "Alice"},
+		Object: MessageObject{Type: "Note", Id: "1", Name: "message", Content: string(content), MediaType: "text/markdown"},
+		Target: MessageTarget{Type: "Collection", Id: "token", Name: "Room"},
+	})
+
+	return string(body)
+}
+
+// talkRequest returns an unsigned request to /message.
+func talkRequest(body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Nextcloud-Talk-Backend", "http://talk.invalid/")
+
+	return request
+}
+
+// signRequest signs a request to /message like Talk does.
+func signRequest(request *http.Request, body string, secret string) {
+	random := strings.Repeat("r", 64)
+	request.Header.Set("X-Nextcloud-Talk-Random", random)
+	request.Header.Set("X-Nextcloud-Talk-Signature", GenerateHmacForString(body, random, secret))
+}
+
+func serve(b *Bot, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	b.messageHandling(recorder, request)
+
+	return recorder
+}
+
+func TestDevSkipSignature(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.dev_skip_signature": true})
+	body := talkBody("hello")
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		signed       bool
+		want         int
+	}{
+		{"loopback unsigned", "127.0.0.1:40000", "", false, http.StatusOK},
+		{"loopback IPv6 unsigned", "[::1]:40000", "", false, http.StatusOK},
+		{"remote unsigned", "192.0.2.10:40000", "", false, http.StatusBadRequest},
+		{"remote signed", "192.0.2.10:40000", "", true, http.StatusOK},
+		{"remote forwarded for loopback unsigned", "192.0.2.10:40000", "127.0.0.1", false, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := talkRequest(body)
+			request.RemoteAddr = test.remoteAddr
+			if test.forwardedFor != "" {
+				request.Header.Set("X-Forwarded-For", test.forwardedFor)
+			}
+			if test.signed {
+				signRequest(request, body, testSecret)
+			}
+
+			if got := serve(b, request).Code; got != test.want {
+				t.Errorf("status = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSignatureRequiredByDefault(t *testing.T) {
+	b := newTestBot(t, nil)
+
+	request := talkRequest(talkBody("hello"))
+	request.RemoteAddr = "127.0.0.1:40000"
+	if got := serve(b, request).Code; got != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", got, http.StatusBadRequest)
+	}
+}
+
+func TestCreateRichMessageEncodings(t *testing.T) {
+	single := `{"message":"@ha turn_on kitchen","parameters":[]}`
+	double, _ := json.Marshal(single)
+
+	for name, content := range map[string]string{"single": single, "double": string(double)} {
+		t.Run(name, func(t *testing.T) {
+			message, err := createRichMessage(content)
+			if err != nil {
+				t.Fatalf("createRichMessage: %s", err)
+			}
+			if message.Message != "@ha turn_on kitchen" {
+				t.Errorf("message = %q, want %q", message.Message, "@ha turn_on kitchen")
+			}
+		})
+	}
+}
+
+func TestCreateRichMessageDecodesOnce(t *testing.T) {
+	// A triple encoded object is only unwrapped once and stays a string
+	single := `{"message":"@ha turn_on kitchen","parameters":[]}`
+	double, _ := json.Marshal(single)
+	triple, _ := json.Marshal(string(double))
+
+	if _, err := createRichMessage(string(triple)); err == nil {
+		t.Error("createRichMessage of triple encoded content succeeded, want error")
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"object", `{"type":"Create"}`, false},
+		{"surrounding whitespace", " \n{\"type\":\"Create\"}\n\t", false},
+		{"second object", `{"type":"Create"}{"type":"Delete"}`, true},
+		{"trailing garbage", `{"type":"Create"} junk`, true},
+		{"trailing bracket", `{"type":"Create"}}`, true},
+		{"trailing number", `{"type":"Create"} 1`, true},
+		{"truncated", `{"type":"Create"`, true},
+		{"empty", ``, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var message Message
+			err := decodeStrict(test.input, &message)
+			if test.wantErr && err != ErrInvalidBody {
+				t.Errorf("decodeStrict(%q) = %v, want %v", test.input, err, ErrInvalidBody)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("decodeStrict(%q) = %v, want no error", test.input, err)
+			}
+		})
+	}
+}
+
+func TestTrailingJunkRejected(t *testing.T) {
+	b := newTestBot(t, nil)
+	body := talkBody("hello") + `{"type":"Delete"}`
+
+	request := talkRequest(body)
+	signRequest(request, body, testSecret)
+	if got := serve(b, request).Code; got != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", got, http.StatusBadRequest)
+	}
+}
+
+func TestMissingTargetMakesNoRequests(t *testing.T) {
+	homeAssistant, haRequests := newTestHomeAssistant(t, http.StatusOK)
+	talk, talkRequests := newTestHomeAssistant(t, http.StatusCreated)
+	b := newTestBot(t, map[string]any{"bot.ha.url": homeAssistant.URL, "bot.ack_processing": true})
+	handler := b.Handler()
+
+	content, _ := json.Marshal(RichObjectMessage{Message: "@ha turn_on kitchen"})
+	bodyJson, _ := json.Marshal(Message{
+		Type:   "Create",
+		Actor:  MessageActor{Type: "Person", Id: "users/alice", Name: "Alice"},
+		Object: MessageObject{Type: "Note", Id: "1", Name: "message", Content: string(content), MediaType: "text/markdown"},
+	})
+	body := string(bodyJson)
+
+	request := talkRequest(body)
+	request.Header.Set("X-Nextcloud-Talk-Backend", talk.URL+"/")
+	signRequest(request, body, testSecret)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	b.Drain()
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+	if len(haRequests) > 0 || len(talkRequests) > 0 {
+		t.Errorf("%d requests to Home Assistant and %d to Talk, want none", len(haRequests), len(talkRequests))
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	server := httptest.NewServer(recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			var args []string
+			_ = args[1]
+		}
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer server.Close()
+
+	for _, test := range []struct {
+		path string
+		want int
+	}{
+		{"/panic", http.StatusInternalServerError},
+		{"/ok", http.StatusOK},
+		{"/panic", http.StatusInternalServerError},
+		{"/ok", http.StatusOK},
+	} {
+		resp, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatalf("GET %s: %s", test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("GET %s = %d, want %d", test.path, resp.StatusCode, test.want)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	b := newTestBot(t, nil)
+
+	for _, body := range []string{"", " \n\t"} {
+		request := talkRequest(body)
+		signRequest(request, body, testSecret)
+
+		recorder := serve(b, request)
+		if recorder.Code != http.StatusBadRequest || strings.TrimSpace(recorder.Body.String()) != "empty body" {
+			t.Errorf("body %q: %d %q, want %d \"empty body\"", body, recorder.Code, strings.TrimSpace(recorder.Body.String()), http.StatusBadRequest)
+		}
+	}
+
+	// Unsigned probes get the same answer, as the body is checked first
+	request := talkRequest("")
+	if recorder := serve(b, request); strings.TrimSpace(recorder.Body.String()) != "empty body" {
+		t.Errorf("unsigned empty body: %d %q, want \"empty body\"", recorder.Code, strings.TrimSpace(recorder.Body.String()))
+	}
+}
+
+func TestBuildTriggerRegex(t *testing.T) {
+	tests := []struct {
+		trigger string
+		text    string
+		want    bool
+	}{
+		{"@ha", "@ha turn_on kitchen", true},
+		{"@ha", "@hat turn_on kitchen", false},
+		{"(ha", "(ha turn_on kitchen", true},
+		{"[ha", "[ha turn_on kitchen", true},
+		{"ha.*", "ha.* turn_on kitchen", true},
+		{"ha.*", "hallo turn_on kitchen", false},
+		{`\`, `\ turn_on kitchen`, true},
+	}
+	for _, test := range tests {
+		regex, err := buildTriggerRegex(test.trigger)
+		if err != nil {
+			t.Errorf("buildTriggerRegex(%q) = %s, want no error", test.trigger, err)
+			continue
+		}
+		if got := regex.MatchString(test.text); got != test.want {
+			t.Errorf("trigger %q matches %q = %t, want %t", test.trigger, test.text, got, test.want)
+		}
+	}
+}
+
+func TestCommandAliases(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]any
+		wantErr  string
+	}{
+		{"aliases", map[string]any{"bot.commands.light.aliases": []string{"Lamp", "lights"}}, ""},
+		{"alias of two commands", map[string]any{"bot.commands.light.aliases": []string{"lamp"}, "bot.commands.switch.aliases": []string{"lamp"}}, `alias "lamp" of command "switch" is already used by command "light"`},
+		{"alias named like a command", map[string]any{"bot.commands.light.aliases": []string{"switch"}, "bot.commands.switch.aliases": []string{}}, `alias "switch" of command "light" is already used by command "switch"`},
+		{"alias named like a built-in", map[string]any{"bot.commands.light.aliases": []string{"Maintenance"}}, `alias "maintenance" of command "light" is already used by a built-in command`},
+		{"command named like a built-in", map[string]any{"bot.commands.help.aliases": []string{}}, `command "help" is already used by a built-in command`},
+		{"command named like a var command", map[string]any{"bot.commands.set.aliases": []string{}}, `command "set" is already used by a built-in command`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(newTestConfig(test.settings))
+			if test.wantErr == "" && err != nil {
+				t.Errorf("New = %s, want no error", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.HasSuffix(err.Error(), test.wantErr)) {
+				t.Errorf("New = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedeliveryAfterFullQueue(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.dedupe_window": "1m"})
+	body := talkBody("@ha turn_on kitchen")
+
+	// Without workers started there is no queue, so the command is dropped
+	request := talkRequest(body)
+	signRequest(request, body, testSecret)
+	if got := serve(b, request).Code; got != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	b.commandQueue = make(chan commandJob, 1)
+	request = talkRequest(body)
+	request.Header.Set("X-Nextcloud-Talk-Random", strings.Repeat("s", 64))
+	request.Header.Set("X-Nextcloud-Talk-Signature", GenerateHmacForString(body, strings.Repeat("s", 64), testSecret))
+	if got := serve(b, request).Code; got != http.StatusOK {
+		t.Fatalf("redelivery status = %d, want %d", got, http.StatusOK)
+	}
+	if len(b.commandQueue) != 1 {
+		t.Errorf("redelivery queued %d commands, want 1", len(b.commandQueue))
+	}
+}
+
+func TestBuiltinCommandsIgnoreCase(t *testing.T) {
+	b := newTestBot(t, nil)
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"@ha Retry", "retry"},
+		{"@ha HELP", "help"},
+		{"@ha Ping", "ping"},
+		{"@ha Set who Alice", "set"},
+		{"@ha Turn_on light.kitchen", "Turn_on"},
+	}
+	for _, test := range tests {
+		command, err := b.ParseCommand(test.text)
+		if err != nil {
+			t.Errorf("ParseCommand(%q) = %s, want no error", test.text, err)
+			continue
+		}
+		if command.Name != test.want {
+			t.Errorf("ParseCommand(%q).Name = %q, want %q", test.text, command.Name, test.want)
+		}
+	}
+}
+
+func TestBareMentionRateLimit(t *testing.T) {
+	b := newTestBot(t, map[string]any{
+		"bot.reply_on_bare_mention": true,
+		"bot.rate_limit.per_minute": 1,
+		"bot.rate_limit.burst":      1,
+		"bot.dedupe_window":         "0s",
+	})
+	b.commandQueue = make(chan commandJob, 10)
+	body := talkBody("@ha hello?")
+
+	for i, random := range []string{"r", "s"} {
+		request := talkRequest(body)
+		request.Header.Set("X-Nextcloud-Talk-Random", strings.Repeat(random, 64))
+		request.Header.Set("X-Nextcloud-Talk-Signature", GenerateHmacForString(body, strings.Repeat(random, 64), testSecret))
+		if got := serve(b, request).Code; got != http.StatusOK {
+			t.Errorf("mention %d: status = %d, want %d", i+1, got, http.StatusOK)
+		}
+	}
+
+	if len(b.commandQueue) != 1 {
+		t.Errorf("%d mentions queued, want 1", len(b.commandQueue))
+	}
+}
@@ -0,0 +1,95 @@
+package bot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// CapturedRequest is a validated request as written to bot.capture_requests.path,
+// one JSON object per line.
+type CapturedRequest struct {
+	Time    time.Time         `json:"time"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// capturedHeaders are the headers kept in captured requests. Other headers may
+// carry credentials of proxies, and the signature and random are dropped so
+// captured requests can't be replayed to the bot.
+var capturedHeaders = []string{"bot.headers.backend"}
+
+// captureRequest appends a validated request to bot.capture_requests.path.
+// The file is only ever appended to and readable by its owner only.
+func (b *Bot) captureRequest(r *http.Request, body []byte) error {
+	path := b.config.GetString("bot.capture_requests.path")
+	if path == "" {
+		return nil
+	}
+
+	captured := CapturedRequest{Time: time.Now(), Headers: map[string]string{"Content-Type": r.Header.Get("Content-Type")}, Body: string(body)}
+	for _, key := range capturedHeaders {
+		name := b.config.GetString(key)
+		captured.Headers[name] = r.Header.Get(name)
+	}
+	line, err := json.Marshal(captured)
+	if err != nil {
+		return err
+	}
+
+	b.captureMu.Lock()
+	defer b.captureMu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// ReadCapturedRequests reads the requests captured to a file.
+func ReadCapturedRequests(path string) ([]CapturedRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []CapturedRequest
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var request CapturedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, scanner.Err()
+}
+
+// NewRequest rebuilds the captured request, signed with the secret of the
+// config like Talk would sign it, so it passes validation again.
+func (c CapturedRequest) NewRequest(config *viper.Viper) *http.Request {
+	request, _ := http.NewRequest(http.MethodPost, "/message", bytes.NewBufferString(c.Body))
+	for name, value := range c.Headers {
+		request.Header.Set(name, value)
+	}
+
+	random := generateRandomBytes(64)
+	request.Header.Set(config.GetString("bot.headers.random"), random)
+	request.Header.Set(config.GetString("bot.headers.signature"), GenerateHmacForString(c.Body, random, config.GetString("bot.secret")))
+
+	return request
+}
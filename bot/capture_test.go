@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	b := newTestBot(t, map[string]any{"bot.capture_requests.path": path})
+
+	body := talkBody("hello")
+	request := talkRequest(body)
+	signRequest(request, body, testSecret)
+	if got := serve(b, request).Code; got != http.StatusOK {
+		t.Fatalf("status = %d, want %d", got, http.StatusOK)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature := request.Header.Get("X-Nextcloud-Talk-Signature"); strings.Contains(string(data), signature) {
+		t.Error("captured request contains the signature")
+	}
+	if random := request.Header.Get("X-Nextcloud-Talk-Random"); strings.Contains(string(data), random) {
+		t.Error("captured request contains the random")
+	}
+
+	captured, err := ReadCapturedRequests(path)
+	if err != nil {
+		t.Fatalf("ReadCapturedRequests: %s", err)
+	}
+	if len(captured) != 1 || captured[0].Body != body {
+		t.Fatalf("captured = %v, want the request", captured)
+	}
+
+	// Without a signature the captured request is rejected by the bot
+	unsigned, _ := http.NewRequest(http.MethodPost, "/message", strings.NewReader(captured[0].Body))
+	for name, value := range captured[0].Headers {
+		unsigned.Header.Set(name, value)
+	}
+	if got := serve(newTestBot(t, nil), unsigned).Code; got != http.StatusBadRequest {
+		t.Errorf("status of the captured request = %d, want %d", got, http.StatusBadRequest)
+	}
+
+	// Replayed requests are signed with the configured secret
+	replayer := newTestBot(t, nil)
+	if got := serve(replayer, captured[0].NewRequest(replayer.config)).Code; got != http.StatusOK {
+		t.Errorf("status of the replayed request = %d, want %d", got, http.StatusOK)
+	}
+}
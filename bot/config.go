@@ -0,0 +1,313 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// replyMessageTypes are the values accepted for bot.reply_message_type.
+var replyMessageTypes = []string{"comment", "silent"}
+
+// webhookMethods are the HTTP methods webhooks can be called with.
+var webhookMethods = []string{"GET", "POST", "PUT"}
+
+const (
+	defaultTrigger  = "@ha"
+	defaultResponse = "Done!"
+	// minNonceLength keeps the random of signed replies hard to guess
+	minNonceLength = 32
+)
+
+// configDefaults holds the default of every setting, so a minimal config only
+// needs the secret and the Home Assistant connection. The type of each default
+// is also the type the setting is validated against.
+var configDefaults = map[string]any{
+	"bot.port":                   8088,
+	"bot.secret":                 "",
+	"bot.ignore_prefixes":        []string{},
+	"bot.trigger":                defaultTrigger,
+	"bot.api_path":               "ocs/v2.php/apps/spreed/api/v1/bot/{token}/message",
+	"bot.responses":              []string{defaultResponse},
+	"bot.nonce_length":           64,
+	"bot.reply_max_retries":      3,
+	"bot.reply_max_retry_after":  30 * time.Second,
+	"bot.mention_actor":          false,
+	"bot.reply_on_bare_mention":  false,
+	"bot.reply_debounce":         time.Duration(0),
+	"bot.reply_message_type":     "comment",
+	"bot.allowed_conversations":  []string{},
+	"bot.admins":                 []string{},
+	"bot.maintenance":            false,
+	"bot.maintenance_message":    "Maintenance in progress, try later",
+	"bot.ack_processing":         false,
+	"bot.ack_message":            "Working…",
+	"bot.slow_command_threshold": 5 * time.Second,
+	"bot.total_deadline":         time.Duration(0),
+	"bot.retry_window":           10 * time.Minute,
+	"bot.ping_cooldown":          30 * time.Second,
+	"bot.ping_admins_only":       false,
+	"bot.vars_max":               20,
+	"bot.vars_ttl":               24 * time.Hour,
+	"bot.vars_admins_only":       false,
+	"bot.vars_file":              "",
+	"bot.rate_limit.per_minute":  0,
+	"bot.rate_limit.burst":       5,
+	"bot.workers":                4,
+	"bot.queue_size":             100,
+	"bot.dev_skip_signature":     false,
+	"bot.replay_window":          10 * time.Minute,
+	"bot.dedupe_window":          10 * time.Minute,
+	"bot.redis.url":              "",
+	"bot.redis.prefix":           "ncbot:",
+	"bot.log.output":             "stderr",
+	"bot.log_level":              "info",
+	"bot.headers.signature":      "X-Nextcloud-Talk-Signature",
+	"bot.headers.random":         "X-Nextcloud-Talk-Random",
+	"bot.headers.backend":        "X-Nextcloud-Talk-Backend",
+
+	"bot.response_fields.message":  "message",
+	"bot.response_fields.reply_to": "replyTo",
+	"bot.response_fields.silent":   "silent",
+
+	"bot.require_json_content_type": false,
+	"bot.echo_command_on_error":     false,
+	"bot.capture_requests.path":     "",
+	"bot.telemetry.webhook":         "",
+	"bot.telemetry.timeout":         2 * time.Second,
+
+	"bot.target_type": "ha_webhook",
+
+	"bot.ha.token":                 "",
+	"bot.ha.url":                   "",
+	"bot.ha.webhook_id":            "",
+	"bot.ha.fallback_url":          "",
+	"bot.ha.fallback_webhook_id":   "",
+	"bot.ha.method":                "POST",
+	"bot.ha.strip_prefix":          true,
+	"bot.ha.forward_raw":           false,
+	"bot.ha.compress":              false,
+	"bot.ha.compress_threshold":    1024,
+	"bot.ha.failed_field":          "",
+	"bot.ha.allowed_domains":       []string{},
+	"bot.ha.allowed_hosts":         []string{},
+	"bot.ha.fanout_concurrency":    4,
+	"bot.ha.fanout_fail_fast":      false,
+	"bot.ha.signing_secret":        "",
+	"bot.ha.signing_header":        "X-Signature",
+	"bot.ha.signing_nonce":         false,
+	"bot.ha.signing_random_header": "X-Random",
+	"bot.ha.timeout":               10 * time.Second,
+	"bot.ha.dial_timeout":          5 * time.Second,
+	"bot.ha.tls_handshake_timeout": 5 * time.Second,
+}
+
+// SetDefaults registers configDefaults on a config before it is read.
+func SetDefaults(v *viper.Viper) {
+	for key, value := range configDefaults {
+		v.SetDefault(key, value)
+	}
+}
+
+// ValidateConfig checks that every setting can be read as the type of its
+// default, as viper silently returns zero values for settings it can't convert.
+func ValidateConfig(v *viper.Viper) error {
+	keys := make([]string, 0, len(configDefaults))
+	for key := range configDefaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		if key == "bot.port" {
+			// Checked below with a more helpful error
+			continue
+		}
+		if err := checkType(v.Get(key), configDefaults[key]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	methodKeys := []string{"bot.ha.method"}
+	for name := range v.GetStringMap("bot.commands") {
+		key := "bot.commands." + name + ".aliases"
+		if err := checkType(v.Get(key), []string{}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+		if key := "bot.commands." + name + ".method"; v.IsSet(key) {
+			methodKeys = append(methodKeys, key)
+		}
+
+		key = "bot.commands." + name + ".patterns"
+		if err := checkType(v.Get(key), []string{}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		} else {
+			for i, pattern := range v.GetStringSlice(key) {
+				if _, err := regexp.Compile(pattern); err != nil {
+					errs = append(errs, fmt.Errorf("%s[%d]: invalid pattern %q: %w", key, i, pattern, err))
+				}
+			}
+		}
+
+		for _, setting := range []string{"payload", "response"} {
+			key := "bot.commands." + name + "." + setting
+			if err := checkType(v.Get(key), ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		}
+
+		for _, setting := range []string{"webhook_ids", "webhook_labels"} {
+			key := "bot.commands." + name + "." + setting
+			if err := checkType(v.Get(key), []string{}); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		}
+
+		key = "bot.commands." + name + ".args"
+		if err := checkType(v.Get(key), []string{}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		for _, hint := range v.GetStringSlice(key) {
+			if !slices.Contains(argTypes, hint) {
+				errs = append(errs, fmt.Errorf("%s: expected one of %s, got %q", key, strings.Join(argTypes, ", "), hint))
+			}
+		}
+	}
+
+	for token := range v.GetStringMap("bot.rate_limit.conversations") {
+		for _, key := range []string{"per_minute", "burst"} {
+			key = "bot.rate_limit.conversations." + token + "." + key
+			if err := checkType(v.Get(key), 0); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		}
+	}
+
+	if targetType := v.GetString("bot.target_type"); !slices.Contains(targetTypes, targetType) {
+		errs = append(errs, fmt.Errorf("bot.target_type: expected one of %s, got %q", strings.Join(targetTypes, ", "), targetType))
+	}
+
+	if messageType := v.GetString("bot.reply_message_type"); !slices.Contains(replyMessageTypes, messageType) {
+		errs = append(errs, fmt.Errorf("bot.reply_message_type: expected one of %s, got %q", strings.Join(replyMessageTypes, ", "), messageType))
+	}
+
+	// An empty port would make the server listen on a random port
+	if port, err := cast.ToIntE(v.Get("bot.port")); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("bot.port must be a valid port number (1-65535), got %#v", v.Get("bot.port")))
+	}
+
+	fieldNames := map[string]bool{}
+	for _, key := range []string{"bot.response_fields.message", "bot.response_fields.reply_to", "bot.response_fields.silent"} {
+		name := v.GetString(key)
+		if name == "" || fieldNames[name] {
+			errs = append(errs, fmt.Errorf("%s: must be a unique field name, got %q", key, name))
+		}
+		fieldNames[name] = true
+	}
+
+	if length := v.GetInt("bot.nonce_length"); length < minNonceLength {
+		errs = append(errs, fmt.Errorf("bot.nonce_length: must be at least %d, got %d", minNonceLength, length))
+	}
+
+	if level := v.GetString("bot.log_level"); !slices.Contains(logLevels, level) {
+		errs = append(errs, fmt.Errorf("bot.log_level: expected one of %s, got %q", strings.Join(logLevels, ", "), level))
+	}
+
+	for _, key := range methodKeys {
+		if method := strings.ToUpper(v.GetString(key)); !slices.Contains(webhookMethods, method) {
+			errs = append(errs, fmt.Errorf("%s: expected one of %s, got %q", key, strings.Join(webhookMethods, ", "), method))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkType(value any, expected any) error {
+	if value == nil {
+		return nil
+	}
+
+	var err error
+	var kind string
+	switch expected.(type) {
+	case int:
+		_, err = cast.ToIntE(value)
+		kind = "a number"
+	case bool:
+		_, err = cast.ToBoolE(value)
+		kind = "true or false"
+	case string:
+		_, err = cast.ToStringE(value)
+		kind = "a string"
+	case time.Duration:
+		_, err = cast.ToDurationE(value)
+		kind = "a duration like 10s"
+	case []string:
+		_, err = cast.ToStringSliceE(value)
+		kind = "a list of strings"
+	}
+	if err != nil {
+		return fmt.Errorf("expected %s, got %#v", kind, value)
+	}
+
+	return nil
+}
+
+// secretKeys are the settings which can be read from a file named by <key>_file.
+var secretKeys = []string{"bot.secret", "bot.ha.token", "bot.ha.signing_secret"}
+
+// resolveSecretFiles reads secrets from the files named by <key>_file, e.g.
+// Docker or Kubernetes secrets. A secret set in the config takes precedence
+// over its file, which takes precedence over the environment variable.
+func resolveSecretFiles(v *viper.Viper) error {
+	for _, key := range secretKeys {
+		if explicit := configValue(v, key); explicit != "" {
+			if v.GetString(key+"_file") != "" {
+				log.Printf("[Config]        WARNING: %s and %s_file are both set, the file is ignored", key, key)
+			}
+			// Environment variables would otherwise win over the config
+			v.Set(key, explicit)
+			continue
+		}
+
+		path := v.GetString(key + "_file")
+		if path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_file: %w", key, err)
+		}
+		v.Set(key, strings.TrimRight(string(data), "\r\n"))
+	}
+
+	return nil
+}
+
+// configValue returns a setting as read from the config, ignoring environment
+// variables and defaults.
+func configValue(v *viper.Viper, key string) string {
+	if !v.InConfig(key) {
+		return ""
+	}
+
+	parts := strings.Split(key, ".")
+	settings := cast.ToStringMap(v.Get(parts[0]))
+	for _, part := range parts[1 : len(parts)-1] {
+		settings = cast.ToStringMap(settings[part])
+	}
+
+	return cast.ToString(settings[parts[len(parts)-1]])
+}
@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// readTestConfig reads a YAML config with defaults registered.
+func readTestConfig(t *testing.T, yaml string) *viper.Viper {
+	t.Helper()
+
+	cfg := viper.New()
+	SetDefaults(cfg)
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatalf("ReadConfig: %s", err)
+	}
+
+	return cfg
+}
+
+func TestEmptyConfigDefaults(t *testing.T) {
+	cfg := readTestConfig(t, "")
+
+	for key, want := range configDefaults {
+		if got := cfg.Get(key); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %#v, want %#v", key, got, want)
+		}
+	}
+
+	if err := ValidateConfig(cfg); err != nil {
+		t.Errorf("ValidateConfig: %s", err)
+	}
+
+	if got := cfg.GetInt("bot.port"); got != 8088 {
+		t.Errorf("bot.port = %d, want 8088", got)
+	}
+	if got := cfg.GetString("bot.trigger"); got != defaultTrigger {
+		t.Errorf("bot.trigger = %q, want %q", got, defaultTrigger)
+	}
+	if got := cfg.GetDuration("bot.ha.timeout"); got != 10*time.Second {
+		t.Errorf("bot.ha.timeout = %s, want 10s", got)
+	}
+}
+
+func TestMinimalConfig(t *testing.T) {
+	cfg := readTestConfig(t, `
+bot:
+  secret: "secret"
+  ha:
+    url: "http://homeassistant.invalid"
+    webhook_id: "webhook"
+`)
+
+	if _, err := New(cfg); err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if got := cfg.GetStringSlice("bot.responses"); !reflect.DeepEqual(got, []string{defaultResponse}) {
+		t.Errorf("bot.responses = %q, want [%q]", got, defaultResponse)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := readTestConfig(t, "bot:\n  secret_file: "+path+"\n")
+	if err := resolveSecretFiles(cfg); err != nil {
+		t.Fatalf("resolveSecretFiles: %s", err)
+	}
+	if got := cfg.GetString("bot.secret"); got != "from-file" {
+		t.Errorf("bot.secret = %q, want %q", got, "from-file")
+	}
+
+	cfg = readTestConfig(t, "bot:\n  secret: secret\n  secret_file: "+path+"\n")
+	if err := resolveSecretFiles(cfg); err != nil {
+		t.Fatalf("resolveSecretFiles: %s", err)
+	}
+	if got := cfg.GetString("bot.secret"); got != "secret" {
+		t.Errorf("bot.secret = %q, want the explicit %q", got, "secret")
+	}
+}
+
+func TestPortValidation(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		wantErr bool
+	}{
+		{"", false},
+		{"bot:\n  port: 8089\n", false},
+		{"bot:\n  port: \"8089\"\n", false},
+		{"bot:\n  port: \"\"\n", true},
+		{"bot:\n  port: abc\n", true},
+		{"bot:\n  port: 0\n", true},
+		{"bot:\n  port: -1\n", true},
+		{"bot:\n  port: 65536\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.yaml, func(t *testing.T) {
+			err := ValidateConfig(readTestConfig(t, test.yaml))
+			if !test.wantErr {
+				if err != nil {
+					t.Errorf("ValidateConfig = %s, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "bot.port must be a valid port number (1-65535)") {
+				t.Errorf("ValidateConfig = %v, want the port error", err)
+			}
+			if err != nil && strings.Contains(err.Error(), "\n") {
+				t.Errorf("ValidateConfig = %q, want a single error", err)
+			}
+		})
+	}
+}
+
+func TestPatternValidation(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		wantErr  string
+	}{
+		{[]string{`^[a-z_]+\.[a-z_]+$`}, ""},
+		{[]string{"", `^\d+$`}, ""},
+		{[]string{`^[a-z_+$`}, `bot.commands.light.patterns[0]: invalid pattern "^[a-z_+$"`},
+		{[]string{"", `(`}, `bot.commands.light.patterns[1]: invalid pattern "("`},
+	}
+	for _, test := range tests {
+		cfg := newTestConfig(map[string]any{"bot.commands.light.patterns": test.patterns})
+
+		err := ValidateConfig(cfg)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("ValidateConfig with %q = %s, want no error", test.patterns, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), test.wantErr)) {
+			t.Errorf("ValidateConfig with %q = %v, want %q", test.patterns, err, test.wantErr)
+		}
+
+		// New refuses to start instead of panicking
+		if _, err := New(cfg); (err != nil) != (test.wantErr != "") {
+			t.Errorf("New with %q = %v, want error %t", test.patterns, err, test.wantErr != "")
+		}
+	}
+}
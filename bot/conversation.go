@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+// conversationState is what the bot remembers about a conversation.
+type conversationState struct {
+	// lastFailed is the last command which failed to reach Home Assistant,
+	// kept until failedUntil for "@ha retry"
+	lastFailed  *Command
+	failedUntil time.Time
+	// vars are set with "@ha set" and passed to payload templates
+	vars map[string]conversationVar
+}
+
+type conversationVar struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// conversations holds the state of every conversation by its token. It is kept
+// in memory, except for vars which can be saved to bot.vars_file, and entries
+// are dropped once they expired.
+type conversations struct {
+	mu     sync.Mutex
+	states map[string]*conversationState
+}
+
+// get returns the state of a conversation, creating it if needed. The caller
+// must hold c.mu.
+func (c *conversations) get(token string) *conversationState {
+	if c.states == nil {
+		c.states = make(map[string]*conversationState)
+	}
+	state, ok := c.states[token]
+	if !ok {
+		state = &conversationState{}
+		c.states[token] = state
+	}
+
+	return state
+}
+
+// prune drops the states which hold nothing anymore. The caller must hold c.mu.
+func (c *conversations) prune(now time.Time) {
+	for token, state := range c.states {
+		if state.lastFailed != nil && now.After(state.failedUntil) {
+			state.lastFailed = nil
+		}
+		for key, variable := range state.vars {
+			if now.After(variable.Expires) {
+				delete(state.vars, key)
+			}
+		}
+		if state.lastFailed == nil && len(state.vars) == 0 {
+			delete(c.states, token)
+		}
+	}
+}
+
+// rememberFailed keeps a failed command for "@ha retry" during bot.retry_window.
+func (b *Bot) rememberFailed(token string, command Command) {
+	window := b.config.GetDuration("bot.retry_window")
+	if window <= 0 {
+		return
+	}
+
+	b.conversations.mu.Lock()
+	defer b.conversations.mu.Unlock()
+
+	now := time.Now()
+	b.conversations.prune(now)
+	state := b.conversations.get(token)
+	state.lastFailed = &command
+	state.failedUntil = now.Add(window)
+}
+
+// forgetFailed drops the failed command of a conversation, as the last command
+// succeeded.
+func (b *Bot) forgetFailed(token string) {
+	b.conversations.mu.Lock()
+	defer b.conversations.mu.Unlock()
+
+	if state, ok := b.conversations.states[token]; ok {
+		state.lastFailed = nil
+	}
+	b.conversations.prune(time.Now())
+}
+
+// failedCommand returns the last failed command of a conversation unless it
+// expired.
+func (b *Bot) failedCommand(token string) (Command, bool) {
+	b.conversations.mu.Lock()
+	defer b.conversations.mu.Unlock()
+
+	b.conversations.prune(time.Now())
+	state, ok := b.conversations.states[token]
+	if !ok || state.lastFailed == nil {
+		return Command{}, false
+	}
+
+	return *state.lastFailed, true
+}
@@ -0,0 +1,95 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingReplies are command replies waiting to be coalesced, by conversation.
+type pendingReplies struct {
+	mu      sync.Mutex
+	pending map[string]*pendingReply
+}
+
+type pendingReply struct {
+	server  string
+	message Message
+	replies []string
+}
+
+// queueReply sends the reply of a command. With bot.reply_debounce the replies
+// of a conversation are collected for that long after the first one and then
+// posted as a single message.
+func (b *Bot) queueReply(ctx context.Context, job commandJob, reply string) {
+	window := b.config.GetDuration("bot.reply_debounce")
+	if window <= 0 {
+		b.sendReply(ctx, job.server, job.message, reply)
+		return
+	}
+
+	token := job.message.Target.Id
+	b.pendingReplies.mu.Lock()
+	defer b.pendingReplies.mu.Unlock()
+
+	if b.pendingReplies.pending == nil {
+		b.pendingReplies.pending = make(map[string]*pendingReply)
+	}
+	if pending, ok := b.pendingReplies.pending[token]; ok {
+		pending.replies = append(pending.replies, reply)
+		return
+	}
+
+	b.pendingReplies.pending[token] = &pendingReply{server: job.server, message: job.message, replies: []string{reply}}
+	time.AfterFunc(window, func() {
+		b.flushReplies(token)
+	})
+}
+
+// flushReplies posts the collected replies of a conversation.
+func (b *Bot) flushReplies(token string) {
+	b.pendingReplies.mu.Lock()
+	pending := b.pendingReplies.pending[token]
+	delete(b.pendingReplies.pending, token)
+	b.pendingReplies.mu.Unlock()
+
+	if pending == nil {
+		return
+	}
+	if len(pending.replies) > 1 {
+		log.Printf("[Response]      Coalescing %d replies in %s", len(pending.replies), token)
+	}
+
+	// The command contexts are done by now, the reply has its own timeout
+	b.sendReply(context.Background(), pending.server, pending.message, summarizeReplies(pending.replies))
+}
+
+// summarizeReplies joins replies into one message. Equal replies are only
+// listed once along with their count, e.g. "Done! (3×)".
+func summarizeReplies(replies []string) string {
+	if len(replies) == 1 {
+		return replies[0]
+	}
+
+	counts := make(map[string]int)
+	var order []string
+	for _, reply := range replies {
+		if counts[reply] == 0 {
+			order = append(order, reply)
+		}
+		counts[reply]++
+	}
+
+	lines := make([]string, 0, len(order))
+	for _, reply := range order {
+		if counts[reply] > 1 {
+			reply = fmt.Sprintf("%s (%d×)", reply, counts[reply])
+		}
+		lines = append(lines, reply)
+	}
+
+	return strings.Join(lines, "\n")
+}
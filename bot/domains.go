@@ -0,0 +1,52 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var entityIdRegex = regexp.MustCompile(`^([a-z_][a-z0-9_]*)\.\w+$`)
+
+// commandDomains returns the Home Assistant domains a command targets: the
+// domain of the service called by ha_rest, and the domain of every positional
+// and named argument which is an entity id like lock.front_door.
+func (b *Bot) commandDomains(command Command) []string {
+	var domains []string
+	if b.config.GetString("bot.target_type") == "ha_rest" {
+		if service, _, err := b.serviceCall(command); err == nil {
+			domain, _, _ := strings.Cut(service, ".")
+			domains = append(domains, domain)
+		}
+	}
+
+	candidates := slices.Clone(command.Args)
+	for _, value := range command.Named {
+		candidates = append(candidates, value)
+	}
+	for _, candidate := range candidates {
+		if match := entityIdRegex.FindStringSubmatch(strings.ToLower(candidate)); match != nil {
+			domains = append(domains, match[1])
+		}
+	}
+
+	return domains
+}
+
+// checkDomains returns an error when bot.ha.allowed_domains is set and one of
+// the domains is not in it.
+func (b *Bot) checkDomains(domains []string) error {
+	allowed := b.config.GetStringSlice("bot.ha.allowed_domains")
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	for _, domain := range domains {
+		if !slices.Contains(allowed, domain) {
+			return fmt.Errorf("domain %s is not allowed", domain)
+		}
+	}
+
+	return nil
+}
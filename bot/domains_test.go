@@ -0,0 +1,58 @@
+package bot
+
+import "testing"
+
+func TestCheckDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		command Command
+		wantErr bool
+	}{
+		{"allowed target", Command{Name: "turn_on", Args: []string{"light.kitchen"}}, false},
+		{"blocked target", Command{Name: "turn_on", Args: []string{"lock.front_door"}}, true},
+		{"blocked target in upper case", Command{Name: "turn_on", Args: []string{"Lock.Front_Door"}}, true},
+		{"no entity id", Command{Name: "turn_on", Args: []string{"kitchen"}}, false},
+		{"blocked further argument", Command{Name: "turn_on", Args: []string{"light.kitchen", "lock.front_door"}}, true},
+		{"allowed further arguments", Command{Name: "turn_on", Args: []string{"light.kitchen", "scene.evening", "50"}}, false},
+		{"blocked entity_id", Command{Name: "turn_on", Args: []string{"light.kitchen"}, Named: map[string]string{"entity_id": "lock.front_door"}}, true},
+		{"blocked other named argument", Command{Name: "turn_on", Args: []string{"light.kitchen"}, Named: map[string]string{"also": "alarm_control_panel.home"}}, true},
+		{"allowed named argument", Command{Name: "turn_on", Args: []string{"light.kitchen"}, Named: map[string]string{"scene": "scene.evening", "level": "5"}}, false},
+	}
+
+	b := newTestBot(t, map[string]any{"bot.ha.allowed_domains": []string{"light", "scene"}})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := b.checkDomains(b.commandDomains(test.command))
+			if test.wantErr && err == nil {
+				t.Errorf("checkDomains(%v) succeeded, want error", test.command)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("checkDomains(%v) = %s, want no error", test.command, err)
+			}
+		})
+	}
+}
+
+func TestCheckDomainsRest(t *testing.T) {
+	b := newTestBot(t, map[string]any{
+		"bot.target_type":                 "ha_rest",
+		"bot.ha.allowed_domains":          []string{"light"},
+		"bot.commands.unlock_all.service": "lock.unlock",
+	})
+
+	if err := b.checkDomains(b.commandDomains(Command{Name: "turn_on", Args: []string{"light.kitchen"}})); err != nil {
+		t.Errorf("checkDomains of light.turn_on = %s, want no error", err)
+	}
+	// The service is checked, even if the target is allowed
+	if err := b.checkDomains(b.commandDomains(Command{Name: "unlock_all", Args: []string{"light.kitchen"}})); err == nil {
+		t.Error("checkDomains of lock.unlock succeeded, want error")
+	}
+}
+
+func TestCheckDomainsUnrestricted(t *testing.T) {
+	b := newTestBot(t, nil)
+
+	if err := b.checkDomains(b.commandDomains(Command{Name: "unlock", Args: []string{"lock.front_door"}})); err != nil {
+		t.Errorf("checkDomains without bot.ha.allowed_domains = %s, want no error", err)
+	}
+}
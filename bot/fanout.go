@@ -0,0 +1,80 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// fanOutLabel names the webhook at position i in replies: by its label in
+// labels, or by its position. Webhook ids are secret, so they are never shown.
+func fanOutLabel(labels []string, i int) string {
+	if i < len(labels) && labels[i] != "" {
+		return labels[i]
+	}
+
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// fanOut sends the payload to several webhooks at once, at most
+// bot.ha.fanout_concurrency at a time. With bot.ha.fanout_fail_fast the calls
+// still running are canceled as soon as one fails. The result summarizes how
+// many calls succeeded, naming failed webhooks by their labels; it is an error
+// only if none did.
+func (b *Bot) fanOut(ctx context.Context, webhookIds []string, labels []string, method string, payload []byte) (Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failFast := b.config.GetBool("bot.ha.fanout_fail_fast")
+	slots := make(chan struct{}, max(b.config.GetInt("bot.ha.fanout_concurrency"), 1))
+	errs := make([]error, len(webhookIds))
+
+	var wg sync.WaitGroup
+	for i, webhookId := range webhookIds {
+		wg.Add(1)
+		go func(i int, webhookId string) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			_, errs[i] = b.callWebhook(ctx, b.haBaseURL()+"/api/webhook/"+webhookId, method, payload)
+			if errs[i] != nil && failFast {
+				cancel()
+			}
+		}(i, webhookId)
+	}
+	wg.Wait()
+
+	var failed []string
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fanOutLabel(labels, i))
+			// Calls canceled by fail fast only followed the actual failure
+			if firstErr == nil || errors.Is(firstErr, context.Canceled) {
+				firstErr = err
+			}
+		}
+	}
+	succeeded := len(webhookIds) - len(failed)
+	log.Printf("[Webhook]       %d/%d webhooks succeeded", succeeded, len(webhookIds))
+
+	summary := fmt.Sprintf("%d/%d succeeded", succeeded, len(webhookIds))
+	if len(failed) > 0 {
+		summary += ", failed: " + strings.Join(failed, ", ")
+	}
+	if succeeded == 0 {
+		return Result{Summary: summary}, firstErr
+	}
+
+	return Result{Summary: summary}, nil
+}
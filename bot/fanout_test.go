@@ -0,0 +1,127 @@
+package bot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestFanOutServer starts a server answering webhooks by their id: ids
+// starting with "ok" succeed, "slow" ones wait until the request is canceled
+// and all others fail with 500.
+func newTestFanOutServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var canceled atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only once the body is read the server notices canceled requests
+		io.Copy(io.Discard, r.Body)
+
+		webhookId := strings.TrimPrefix(r.URL.Path, "/api/webhook/")
+		switch {
+		case strings.HasPrefix(webhookId, "ok"):
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(webhookId, "slow"):
+			select {
+			case <-r.Context().Done():
+				canceled.Add(1)
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &canceled
+}
+
+func TestFanOut(t *testing.T) {
+	server, _ := newTestFanOutServer(t)
+
+	tests := []struct {
+		name        string
+		webhookIds  []string
+		labels      []string
+		wantSummary string
+		wantErr     bool
+	}{
+		{"all succeed", []string{"ok-secret-1", "ok-secret-2", "ok-secret-3"}, nil, "3/3 succeeded", false},
+		{"mixed", []string{"ok-secret-1", "fail-secret-2", "ok-secret-3"}, nil, "2/3 succeeded, failed: #2", false},
+		{"mixed with labels", []string{"ok-secret-1", "fail-secret-2", "fail-secret-3"}, []string{"house", "garage"}, "1/3 succeeded, failed: garage, #3", false},
+		{"all fail", []string{"fail-secret-1", "fail-secret-2"}, nil, "0/2 succeeded, failed: #1, #2", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t, map[string]any{"bot.ha.url": server.URL, "bot.ha.fanout_concurrency": 2})
+
+			result, err := b.fanOut(context.Background(), test.webhookIds, test.labels, http.MethodPost, []byte(`{}`))
+			if result.Summary != test.wantSummary {
+				t.Errorf("summary = %q, want %q", result.Summary, test.wantSummary)
+			}
+			if strings.Contains(result.Summary, "secret") {
+				t.Errorf("summary %q contains a webhook id", result.Summary)
+			}
+			if test.wantErr && err == nil {
+				t.Error("fanOut succeeded, want error")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("fanOut = %s, want no error", err)
+			}
+		})
+	}
+}
+
+func TestFanOutFailFast(t *testing.T) {
+	server, _ := newTestFanOutServer(t)
+	b := newTestBot(t, map[string]any{"bot.ha.url": server.URL, "bot.ha.fanout_fail_fast": true})
+
+	start := time.Now()
+	result, err := b.fanOut(context.Background(), []string{"slow-1", "fail-2", "slow-3"}, nil, http.MethodPost, []byte(`{}`))
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fanOut took %s, want the slow calls canceled", elapsed)
+	}
+	if err == nil || strings.Contains(err.Error(), "context canceled") {
+		t.Errorf("fanOut = %v, want the error of the failed call", err)
+	}
+	if want := "0/3 succeeded, failed: #1, #2, #3"; result.Summary != want {
+		t.Errorf("summary = %q, want %q", result.Summary, want)
+	}
+}
+
+func TestFanOutDeadline(t *testing.T) {
+	server, canceled := newTestFanOutServer(t)
+	b := newTestBot(t, map[string]any{"bot.ha.url": server.URL})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	result, _ := b.fanOut(ctx, []string{"ok-1", "slow-2", "slow-3"}, nil, http.MethodPost, []byte(`{}`))
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fanOut took %s, want the calls canceled at the deadline", elapsed)
+	}
+	if want := "1/3 succeeded, failed: #2, #3"; result.Summary != want {
+		t.Errorf("summary = %q, want %q", result.Summary, want)
+	}
+	waitFor(t, func() bool { return canceled.Load() == 2 })
+}
+
+// waitFor fails the test unless condition becomes true within a second.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
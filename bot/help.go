@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// helpText describes how to send commands, along with the configured commands
+// and the built-in commands the actor may use.
+func (b *Bot) helpText(actor MessageActor) string {
+	lines := []string{fmt.Sprintf("Send commands as %s <command> <target> [arguments], e.g. %s turn_on kitchen", b.triggerPrefix, b.triggerPrefix)}
+
+	commands := make([]string, 0)
+	for name := range b.config.GetStringMap("bot.commands") {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+	if len(commands) > 0 {
+		lines = append(lines, "Commands: "+strings.Join(commands, ", "))
+	}
+
+	builtins := []string{"help", "ping", "retry", "set", "unset", "vars"}
+	if b.isAdmin(actor) {
+		builtins = append(builtins, adminCommands...)
+	}
+	lines = append(lines, "Built-in: "+strings.Join(builtins, ", "))
+
+	return strings.Join(lines, "\n")
+}
+
+// handleHelpCommand answers "@ha help" and reports whether the command was help.
+func (b *Bot) handleHelpCommand(ctx context.Context, job commandJob, command Command) bool {
+	if command.Name != "help" || len(command.Args) > 0 || len(command.Named) > 0 {
+		return false
+	}
+
+	b.sendReply(ctx, job.server, job.message, b.helpText(job.message.Actor))
+	return true
+}
@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// errBlockedAddress is returned when Home Assistant is to be called at an
+// address which is never allowed.
+var errBlockedAddress = errors.New("blocked address")
+
+// metadataAddresses are cloud metadata endpoints which are not link-local.
+var metadataAddresses = []netip.Addr{
+	netip.MustParseAddr("fd00:ec2::254"),
+}
+
+// checkOutboundURL guards against calling internal services by mistake: the
+// host must be in bot.ha.allowed_hosts if that is set. The address the host
+// resolves to is checked by checkDialAddress when connecting.
+func (b *Bot) checkOutboundURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(parsed.Hostname())
+
+	if allowed := b.config.GetStringSlice("bot.ha.allowed_hosts"); len(allowed) > 0 && !slices.Contains(allowed, host) {
+		return fmt.Errorf("host %s is not in bot.ha.allowed_hosts", host)
+	}
+
+	return nil
+}
+
+// isBlockedAddress reports whether Home Assistant must never be called at an
+// address, like the link-local metadata endpoint 169.254.169.254.
+func isBlockedAddress(address netip.Addr) bool {
+	address = address.Unmap()
+	return address.IsLinkLocalUnicast() || address.IsLinkLocalMulticast() || address.IsUnspecified() || slices.Contains(metadataAddresses, address)
+}
+
+// checkDialAddress is the Control hook of the dialer calling Home Assistant.
+// It sees the address actually connected to, so a host can't pass a separate
+// DNS lookup and then resolve to a blocked address (DNS rebinding).
+func checkDialAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if isBlockedAddress(ip) {
+		return fmt.Errorf("%w %s", errBlockedAddress, ip.Unmap())
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCheckDialAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"169.254.169.254:80", true},
+		{"[::ffff:169.254.169.254]:80", true},
+		{"[fe80::1]:8123", true},
+		{"[ff02::1]:8123", true},
+		{"0.0.0.0:8123", true},
+		{"[::]:8123", true},
+		{"[fd00:ec2::254]:80", true},
+		{"127.0.0.1:8123", false},
+		{"192.168.1.10:8123", false},
+		{"[2001:db8::1]:8123", false},
+	}
+	for _, test := range tests {
+		err := checkDialAddress("tcp", test.address, nil)
+		if test.blocked && !errors.Is(err, errBlockedAddress) {
+			t.Errorf("checkDialAddress(%s) = %v, want blocked", test.address, err)
+		}
+		if !test.blocked && err != nil {
+			t.Errorf("checkDialAddress(%s) = %s, want no error", test.address, err)
+		}
+	}
+}
+
+func TestBlockedAddressIsNotCalled(t *testing.T) {
+	// The dialer refuses before connecting, so nothing listens there
+	b := newTestBot(t, map[string]any{"bot.ha.url": "http://169.254.169.254"})
+
+	_, err := b.callWebhook(context.Background(), b.webhookURL(), http.MethodPost, []byte(`{}`))
+
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Kind != FailureBlockedAddress || callErr.Temporary() {
+		t.Errorf("callWebhook = %v, want a permanent %s", err, FailureBlockedAddress)
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	server, received := newTestHomeAssistant(t, http.StatusOK)
+
+	tests := []struct {
+		name    string
+		allowed []string
+		wantErr bool
+	}{
+		{"not restricted", nil, false},
+		{"allowed", []string{"127.0.0.1"}, false},
+		{"not allowed", []string{"homeassistant"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t, map[string]any{
+				"bot.ha.url":           server.URL,
+				"bot.ha.token":         "token",
+				"bot.ha.allowed_hosts": test.allowed,
+			})
+
+			calls := []struct {
+				name string
+				call func() error
+			}{
+				{"webhook", func() error {
+					_, err := b.callWebhook(context.Background(), b.webhookURL(), http.MethodPost, []byte(`{}`))
+					return err
+				}},
+				{"service", func() error {
+					_, err := b.callService(context.Background(), "light.turn_on", map[string]any{"entity_id": "light.kitchen"})
+					return err
+				}},
+				{"ping", func() error {
+					_, err := b.checkHomeAssistant(context.Background())
+					return err
+				}},
+			}
+			for _, call := range calls {
+				err := call.call()
+				if test.wantErr && err == nil {
+					t.Errorf("%s succeeded, want error", call.name)
+				}
+				if !test.wantErr && err != nil {
+					t.Errorf("%s = %s, want no error", call.name, err)
+				}
+
+				if requests := len(received); test.wantErr && requests > 0 {
+					t.Errorf("%s sent %d requests, want none", call.name, requests)
+				}
+				for len(received) > 0 {
+					<-received
+				}
+			}
+		})
+	}
+}
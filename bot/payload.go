@@ -0,0 +1,274 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"text/template"
+	"text/template/parse"
+)
+
+// argTypes are the type hints accepted in bot.commands.<name>.args.
+var argTypes = []string{"string", "number", "bool"}
+
+// payloadData is passed to payload templates.
+type payloadData struct {
+	Prefix string
+	Action string
+	Target any
+	Args   []any
+	Named  map[string]string
+	Vars   map[string]string
+}
+
+// escapingFuncs are the template functions escaping a value for JSON. Every
+// output of a payload template must be passed to one of them.
+var escapingFuncs = []string{"json", "jsonstr"}
+
+// buildPayloadTemplates parses the payload template of every command, so a
+// broken template stops the bot at startup.
+func (b *Bot) buildPayloadTemplates() (map[string]*template.Template, error) {
+	templates, err := b.buildCommandTemplates("payload", template.FuncMap{"json": toJson, "jsonstr": toJsonString})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, tmpl := range templates {
+		for _, defined := range tmpl.Templates() {
+			if err := checkEscaped(defined.Tree.Root); err != nil {
+				return nil, fmt.Errorf("command %q: %w", name, err)
+			}
+		}
+	}
+
+	return templates, nil
+}
+
+// checkEscaped returns an error for the first action of a template which
+// outputs a value without passing it to json or jsonstr, as text/template
+// would insert e.g. quotes of an argument as they are.
+func checkEscaped(node parse.Node) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, child := range node.Nodes {
+			if err := checkEscaped(child); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		if len(node.Pipe.Decl) > 0 {
+			// Assignments output nothing
+			return nil
+		}
+		last := node.Pipe.Cmds[len(node.Pipe.Cmds)-1]
+		if ident, ok := last.Args[0].(*parse.IdentifierNode); !ok || !slices.Contains(escapingFuncs, ident.Ident) {
+			return fmt.Errorf("%s must be passed to json or jsonstr, e.g. {{jsonstr .Target}}", node)
+		}
+	case *parse.IfNode:
+		return checkBranch(&node.BranchNode)
+	case *parse.RangeNode:
+		return checkBranch(&node.BranchNode)
+	case *parse.WithNode:
+		return checkBranch(&node.BranchNode)
+	}
+
+	return nil
+}
+
+func checkBranch(node *parse.BranchNode) error {
+	if err := checkEscaped(node.List); err != nil {
+		return err
+	}
+
+	return checkEscaped(node.ElseList)
+}
+
+// buildCommandTemplates parses the templates in bot.commands.<name>.<setting>
+// by command name.
+func (b *Bot) buildCommandTemplates(setting string, funcs template.FuncMap) (map[string]*template.Template, error) {
+	names := make([]string, 0)
+	for name := range b.config.GetStringMap("bot.commands") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := make(map[string]*template.Template)
+	for _, name := range names {
+		text := b.config.GetString("bot.commands." + name + "." + setting)
+		if text == "" {
+			continue
+		}
+
+		tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("command %q: %w", name, err)
+		}
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+func toJson(value any) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+// toJsonString escapes a value for use inside a JSON string, e.g.
+// "light.{{jsonstr .Target}}".
+func toJsonString(value any) string {
+	if value == nil {
+		return ""
+	}
+	encoded, _ := json.Marshal(fmt.Sprint(value))
+	return string(encoded[1 : len(encoded)-1])
+}
+
+// isJsonNumber reports whether text is a finite number as JSON writes it, which
+// rules out NaN, Inf and the hex and underscore forms strconv accepts.
+func isJsonNumber(text string) bool {
+	value, err := strconv.ParseFloat(text, 64)
+	return err == nil && !math.IsNaN(value) && !math.IsInf(value, 0) && json.Valid([]byte(text))
+}
+
+// coerceArgs converts the arguments of a command to the types configured in
+// bot.commands.<name>.args. Arguments without a type hint stay strings. The
+// errors quote arguments neutralized, as they are replied to the chat.
+func (b *Bot) coerceArgs(command Command) ([]any, error) {
+	hints := b.config.GetStringSlice("bot.commands." + command.Name + ".args")
+
+	args := make([]any, len(command.Args))
+	for i, arg := range command.Args {
+		hint := "string"
+		if i < len(hints) {
+			hint = hints[i]
+		}
+
+		switch hint {
+		case "number":
+			if !isJsonNumber(arg) {
+				return nil, fmt.Errorf("argument %d ('%s') must be a number", i+1, neutralizeText(arg, maxEchoLength))
+			}
+			args[i] = json.Number(arg)
+		case "bool":
+			value, err := strconv.ParseBool(arg)
+			if err != nil {
+				return nil, fmt.Errorf("argument %d ('%s') must be true or false", i+1, neutralizeText(arg, maxEchoLength))
+			}
+			args[i] = value
+		default:
+			args[i] = arg
+		}
+	}
+
+	return args, nil
+}
+
+// buildArgPatterns compiles the patterns of bot.commands.<name>.patterns, so an
+// invalid pattern stops the bot at startup. An empty pattern accepts any
+// argument at its position.
+func (b *Bot) buildArgPatterns() (map[string][]*regexp.Regexp, error) {
+	names := make([]string, 0)
+	for name := range b.config.GetStringMap("bot.commands") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	patterns := make(map[string][]*regexp.Regexp)
+	for _, name := range names {
+		for i, pattern := range b.config.GetStringSlice("bot.commands." + name + ".patterns") {
+			var compiled *regexp.Regexp
+			if pattern != "" {
+				var err error
+				if compiled, err = regexp.Compile(pattern); err != nil {
+					return nil, fmt.Errorf("command %q, argument %d: %w", name, i+1, err)
+				}
+			}
+			patterns[name] = append(patterns[name], compiled)
+		}
+	}
+
+	return patterns, nil
+}
+
+// validateArgs checks the arguments of a command against its patterns. The
+// error quotes the argument neutralized, as it is replied to the chat.
+func (b *Bot) validateArgs(command Command) error {
+	patterns := b.argPatterns[command.Name]
+	for i, arg := range command.Args {
+		if i < len(patterns) && patterns[i] != nil && !patterns[i].MatchString(arg) {
+			return fmt.Errorf("argument %d ('%s') is invalid", i+1, neutralizeText(arg, maxEchoLength))
+		}
+	}
+
+	return nil
+}
+
+// buildPayload formats a command for the webhook, or returns the Talk request
+// body untouched when bot.ha.forward_raw is enabled.
+func (b *Bot) buildPayload(command Command) ([]byte, error) {
+	if b.config.GetBool("bot.ha.forward_raw") {
+		return command.Raw, nil
+	}
+
+	return b.commandToJson(command)
+}
+
+// commandToJson renders the payload template of the command, or by default
+// {"action": ..., "target": ..., "args": [...]} where args holds any further
+// arguments after the target.
+func (b *Bot) commandToJson(command Command) ([]byte, error) {
+	args, err := b.coerceArgs(command)
+	if err != nil {
+		return nil, err
+	}
+
+	data := payloadData{
+		Prefix: command.Prefix,
+		Action: command.Name,
+		Args:   args,
+		Named:  command.Named,
+		Vars:   command.Vars,
+	}
+	if len(args) > 0 {
+		data.Target = args[0]
+	}
+
+	if tmpl, ok := b.payloadTemplates[command.Name]; ok {
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return nil, fmt.Errorf("rendering payload: %w", err)
+		}
+		if !json.Valid(rendered.Bytes()) {
+			return nil, fmt.Errorf("payload of %s is not valid JSON", command.Name)
+		}
+
+		return rendered.Bytes(), nil
+	}
+
+	fields := map[string]any{
+		"action": data.Action,
+	}
+	if len(args) > 0 {
+		fields["target"] = data.Target
+	}
+	if len(args) > 1 {
+		fields["args"] = args[1:]
+	}
+	if len(command.Named) > 0 {
+		fields["named"] = command.Named
+	}
+	if !b.config.GetBool("bot.ha.strip_prefix") {
+		fields["prefix"] = data.Prefix
+	}
+
+	return json.Marshal(fields)
+}
@@ -0,0 +1,180 @@
+package bot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPrefixNotInPayload(t *testing.T) {
+	for _, trigger := range []string{"!", "@ha", "@homeassistant", "hey home assistant"} {
+		t.Run(trigger, func(t *testing.T) {
+			b := newTestBot(t, map[string]any{"bot.trigger": trigger})
+
+			command, err := b.ParseCommand(trigger + " turn_on kitchen")
+			if err != nil {
+				t.Fatalf("ParseCommand: %s", err)
+			}
+			payload, err := b.commandToJson(command)
+			if err != nil {
+				t.Fatalf("commandToJson: %s", err)
+			}
+
+			var fields map[string]any
+			if err := json.Unmarshal(payload, &fields); err != nil {
+				t.Fatalf("payload %s: %s", payload, err)
+			}
+			if fields["action"] != "turn_on" || fields["target"] != "kitchen" {
+				t.Errorf("payload = %s, want action turn_on and target kitchen", payload)
+			}
+			if _, found := fields["prefix"]; found {
+				t.Errorf("payload = %s, want no prefix", payload)
+			}
+			for _, word := range strings.Fields(trigger) {
+				if strings.Contains(string(payload), word) {
+					t.Errorf("payload = %s, contains %q of the trigger", payload, word)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixInPayloadWhenNotStripped(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.trigger": "hey home assistant", "bot.ha.strip_prefix": false})
+
+	command, err := b.ParseCommand("hey home assistant turn_on kitchen")
+	if err != nil {
+		t.Fatalf("ParseCommand: %s", err)
+	}
+	payload, err := b.commandToJson(command)
+	if err != nil {
+		t.Fatalf("commandToJson: %s", err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatalf("payload %s: %s", payload, err)
+	}
+	if fields["prefix"] != "hey home assistant" || fields["action"] != "turn_on" {
+		t.Errorf("payload = %s, want prefix \"hey home assistant\" and action turn_on", payload)
+	}
+}
+
+func TestPayloadTemplateEscapesArguments(t *testing.T) {
+	b := newTestBot(t, map[string]any{
+		"bot.commands.brightness.args":    []string{"string", "number"},
+		"bot.commands.brightness.payload": `{"entity_id": "light.{{jsonstr .Target}}", "brightness_step": {{json (index .Args 1)}}}`,
+	})
+
+	command, err := b.ParseCommand(`@ha brightness "kitchen\", \"entity_id\": \"lock.front_door" 5`)
+	if err != nil {
+		t.Fatalf("ParseCommand: %s", err)
+	}
+	payload, err := b.commandToJson(command)
+	if err != nil {
+		t.Fatalf("commandToJson: %s", err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatalf("payload %s: %s", payload, err)
+	}
+	if want := `light.kitchen", "entity_id": "lock.front_door`; fields["entity_id"] != want || len(fields) != 2 {
+		t.Errorf("payload = %s, want entity_id %q and brightness_step only", payload, want)
+	}
+}
+
+func TestPayloadTemplateRequiresEscaping(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  bool
+	}{
+		{`{"entity_id": "light.{{.Target}}"}`, true},
+		{`{"entity_id": {{index .Args 0}}}`, true},
+		{`{"entity_id": "{{.Target | printf "%s"}}"}`, true},
+		{`{{if .Named.level}}{"level": {{.Named.level}}}{{end}}`, true},
+		{`{{range .Args}}{{.}}{{end}}`, true},
+		{`{{define "x"}}{{.Target}}{{end}}{"entity_id": "{{template "x" .}}"}`, true},
+		{`{"entity_id": "light.{{jsonstr .Target}}"}`, false},
+		{`{"entity_id": {{json .Target}}}`, false},
+		{`{"entity_id": "{{.Target | printf "light.%s" | jsonstr}}"}`, false},
+		{`{{$target := .Target}}{"entity_id": {{json $target}}}`, false},
+		{`{"args": [{{range $i, $arg := .Args}}{{if $i}},{{end}}{{json $arg}}{{end}}]}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			_, err := New(newTestConfig(map[string]any{"bot.commands.light.payload": test.template}))
+			if test.wantErr && err == nil {
+				t.Error("New succeeded, want error")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("New: %s", err)
+			}
+		})
+	}
+}
+
+func TestCoerceNumbers(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.commands.brightness.args": []string{"string", "number"}})
+
+	for _, arg := range []string{"128", "-1.5", "2e3", "0"} {
+		args, err := b.coerceArgs(Command{Name: "brightness", Args: []string{"kitchen", arg}})
+		if err != nil {
+			t.Errorf("coerceArgs(%q): %s", arg, err)
+			continue
+		}
+		if encoded, err := json.Marshal(args); err != nil {
+			t.Errorf("coerceArgs(%q) = %v, can't be encoded: %s", arg, args, err)
+		} else if want := `["kitchen",` + arg + `]`; string(encoded) != want {
+			t.Errorf("coerceArgs(%q) = %s, want %s", arg, encoded, want)
+		}
+	}
+
+	for _, arg := range []string{"NaN", "nan", "Inf", "-Infinity", "1e999", "0x10", "1_000", "+1", ".5", "bright"} {
+		_, err := b.coerceArgs(Command{Name: "brightness", Args: []string{"kitchen", arg}})
+		if err == nil || !strings.HasSuffix(err.Error(), "must be a number") {
+			t.Errorf("coerceArgs(%q) = %v, want \"must be a number\"", arg, err)
+		}
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.commands.turn_on.patterns": []string{`^[a-z_]+\.[a-z_]+$`, "", `^\d+$`}})
+
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"light.kitchen"}, ""},
+		{[]string{"light.kitchen", "anything goes", "50"}, ""},
+		{[]string{"light.kitchen", "fast", "50", "unchecked"}, ""},
+		{[]string{"kitchen"}, "argument 1 ('kitchen') is invalid"},
+		{[]string{"light.kitchen", "fast", "fifty"}, "argument 3 ('fifty') is invalid"},
+		{[]string{"@all"}, "argument 1 ('@\u200ball') is invalid"},
+	}
+	for _, test := range tests {
+		err := b.validateArgs(Command{Name: "turn_on", Args: test.args})
+		if test.wantErr == "" && err != nil {
+			t.Errorf("validateArgs(%q) = %s, want no error", test.args, err)
+		}
+		if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("validateArgs(%q) = %v, want %q", test.args, err, test.wantErr)
+		}
+	}
+
+	// Commands without patterns accept any argument
+	if err := b.validateArgs(Command{Name: "turn_off", Args: []string{"kitchen"}}); err != nil {
+		t.Errorf("validateArgs without patterns = %s, want no error", err)
+	}
+}
+
+func TestCoerceArgsErrorsDontMention(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.commands.dim.args": []string{"number", "bool"}})
+
+	for _, args := range [][]string{{"@all"}, {"1", "@all"}} {
+		_, err := b.coerceArgs(Command{Name: "dim", Args: args})
+		if err == nil || strings.Contains(err.Error(), "@all") {
+			t.Errorf("coerceArgs(%q) = %v, want an error without the mention", args, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// checkHomeAssistant requests the API root of Home Assistant and returns how
+// long it took to answer. Any answer counts as reachable, as webhook setups
+// have no token and get 401 Unauthorized.
+func (b *Bot) checkHomeAssistant(ctx context.Context) (time.Duration, error) {
+	requestURL := b.haBaseURL() + "/api/"
+	if err := b.checkOutboundURL(requestURL); err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token := b.config.GetString("bot.ha.token"); token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	start := time.Now()
+	resp, err := b.webhookClient.Do(request)
+	if err != nil {
+		return 0, classifyRequestError(err)
+	}
+	resp.Body.Close()
+
+	return time.Since(start), nil
+}
+
+// handlePingCommand answers "@ha ping" with whether Home Assistant can be
+// reached, and reports whether the command was ping. Each conversation can
+// ping once per bot.ping_cooldown.
+func (b *Bot) handlePingCommand(ctx context.Context, job commandJob, command Command) bool {
+	if command.Name != "ping" || len(command.Args) > 0 || len(command.Named) > 0 {
+		return false
+	}
+
+	if b.config.GetBool("bot.ping_admins_only") && !b.isAdmin(job.message.Actor) {
+		log.Printf("[Talk]          %s is not allowed to use ping", job.message.Actor.Id)
+		b.sendReply(ctx, job.server, job.message, "You are not allowed to use this command")
+		return true
+	}
+
+	if cooldown := b.config.GetDuration("bot.ping_cooldown"); cooldown > 0 {
+		recent, err := b.store.Seen(ctx, "ping:"+job.message.Target.Id, cooldown)
+		if err != nil {
+			log.Printf("[Talk]          Error checking ping cooldown: %s", err)
+		} else if recent {
+			log.Printf("[Talk]          Ignoring ping in %s during cooldown", job.message.Target.Id)
+			return true
+		}
+	}
+
+	latency, err := b.checkHomeAssistant(ctx)
+	if err != nil {
+		log.Printf("[Talk]          Ping failed: %s", err)
+		b.sendReply(ctx, job.server, job.message, fmt.Sprintf("Home Assistant is unreachable (%s)", err))
+		return true
+	}
+
+	b.sendReply(ctx, job.server, job.message, fmt.Sprintf("Home Assistant is reachable (%d ms)", latency.Milliseconds()))
+	return true
+}
@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows burst commands at once, refilled at rate per second.
+type tokenBucket struct {
+	tokens   float64
+	rate     float64
+	burst    float64
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per conversation.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// rateLimit returns the commands per minute and burst of a conversation, as set
+// in bot.rate_limit.conversations.<token>, or else bot.rate_limit.
+func (b *Bot) rateLimit(token string) (perMinute int, burst int) {
+	perMinute = b.config.GetInt("bot.rate_limit.per_minute")
+	burst = b.config.GetInt("bot.rate_limit.burst")
+
+	// Viper lower cases keys
+	for key := range b.config.GetStringMap("bot.rate_limit.conversations") {
+		if !strings.EqualFold(key, token) {
+			continue
+		}
+		prefix := "bot.rate_limit.conversations." + key
+		if b.config.IsSet(prefix + ".per_minute") {
+			perMinute = b.config.GetInt(prefix + ".per_minute")
+		}
+		if b.config.IsSet(prefix + ".burst") {
+			burst = b.config.GetInt(prefix + ".burst")
+		}
+	}
+
+	return perMinute, max(burst, 1)
+}
+
+// allowCommand takes a token from the bucket of a conversation and reports
+// whether the command may run. A rate of 0 allows all commands.
+func (b *Bot) allowCommand(token string) bool {
+	perMinute, burst := b.rateLimit(token)
+	if perMinute <= 0 {
+		return true
+	}
+
+	b.rateLimiter.mu.Lock()
+	defer b.rateLimiter.mu.Unlock()
+
+	now := time.Now()
+	if b.rateLimiter.buckets == nil {
+		b.rateLimiter.buckets = make(map[string]*tokenBucket)
+	}
+	if now.Sub(b.rateLimiter.lastPrune) > time.Minute {
+		// Buckets which are full again are the same as new ones
+		for key, bucket := range b.rateLimiter.buckets {
+			if bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*bucket.rate >= bucket.burst {
+				delete(b.rateLimiter.buckets, key)
+			}
+		}
+		b.rateLimiter.lastPrune = now
+	}
+
+	bucket, ok := b.rateLimiter.buckets[token]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), lastSeen: now}
+		b.rateLimiter.buckets[token] = bucket
+	}
+	bucket.rate = float64(perMinute) / 60
+	bucket.burst = float64(burst)
+	bucket.tokens = min(bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*bucket.rate, bucket.burst)
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
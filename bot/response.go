@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// buildResponseTemplates parses the response template of every command, so a
+// broken template stops the bot at startup.
+func (b *Bot) buildResponseTemplates() (map[string]*template.Template, error) {
+	return b.buildCommandTemplates("response", template.FuncMap{
+		"json":  toJson,
+		"list":  markdownList,
+		"table": markdownTable,
+	})
+}
+
+// formatValue renders a value of a JSON response as text.
+func formatValue(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case map[string]any, []any:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+
+	return fmt.Sprint(value)
+}
+
+// markdownList renders a list as markdown list, one item per line.
+func markdownList(items any) (string, error) {
+	list, ok := items.([]any)
+	if !ok {
+		return "", fmt.Errorf("list: expected a list, got %T", items)
+	}
+
+	lines := make([]string, 0, len(list))
+	for _, item := range list {
+		lines = append(lines, "- "+formatValue(item))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// markdownTable renders a list of objects as markdown table. The columns are
+// the given keys, or all keys of the objects in alphabetical order.
+func markdownTable(items any, columns ...string) (string, error) {
+	list, ok := items.([]any)
+	if !ok {
+		return "", fmt.Errorf("table: expected a list, got %T", items)
+	}
+
+	rows := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		row, ok := item.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("table: expected a list of objects, got %T", item)
+		}
+		rows = append(rows, row)
+	}
+
+	if len(columns) == 0 {
+		seen := make(map[string]bool)
+		for _, row := range rows {
+			for key := range row {
+				if !seen[key] {
+					seen[key] = true
+					columns = append(columns, key)
+				}
+			}
+		}
+		sort.Strings(columns)
+	}
+	if len(columns) == 0 {
+		return "", nil
+	}
+
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+	var table strings.Builder
+	table.WriteString("| " + strings.Join(columns, " | ") + " |\n")
+	table.WriteString("|" + strings.Repeat(" --- |", len(columns)))
+	for _, row := range rows {
+		cells := make([]string, 0, len(columns))
+		for _, column := range columns {
+			cells = append(cells, escape.Replace(formatValue(row[column])))
+		}
+		table.WriteString("\n| " + strings.Join(cells, " | ") + " |")
+	}
+
+	return table.String(), nil
+}
+
+// renderResponse renders the response template of a command with the decoded
+// JSON response of Home Assistant. ok is false when the command has no
+// template or the response is not JSON.
+func (b *Bot) renderResponse(command Command, body []byte) (reply string, ok bool, err error) {
+	tmpl, found := b.responseTemplates[command.Name]
+	if !found {
+		return "", false, nil
+	}
+
+	var data any
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", false, nil
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", false, fmt.Errorf("rendering response: %w", err)
+	}
+
+	return strings.TrimSpace(rendered.String()), true, nil
+}
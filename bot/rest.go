@@ -0,0 +1,133 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// haRestTarget calls Home Assistant services via the REST API. A command like
+// "@ha turn_on light.kitchen" calls the service light.turn_on for the entity.
+type haRestTarget struct {
+	bot *Bot
+}
+
+// serviceCall resolves the service and service data for a command. The domain
+// is taken from the entity id unless bot.commands.<name>.service is set.
+func (b *Bot) serviceCall(command Command) (service string, data map[string]any, err error) {
+	if len(command.Args) == 0 {
+		return "", nil, errors.New("missing entity id, e.g. light.kitchen")
+	}
+	entity := command.Args[0]
+
+	service = b.config.GetString("bot.commands." + command.Name + ".service")
+	if service == "" {
+		domain, _, found := strings.Cut(entity, ".")
+		if !found {
+			return "", nil, fmt.Errorf("'%s' is not an entity id like light.kitchen", neutralizeText(entity, maxEchoLength))
+		}
+		service = domain + "." + command.Name
+	}
+
+	return service, map[string]any{"entity_id": entity}, nil
+}
+
+func (b *Bot) newServiceRequest(ctx context.Context, service string, data map[string]any) (*http.Request, []byte, error) {
+	domain, name, found := strings.Cut(service, ".")
+	if !found {
+		return nil, nil, fmt.Errorf("%q is not a service like light.turn_on", service)
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, b.haBaseURL()+"/api/services/"+domain+"/"+name, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+b.config.GetString("bot.ha.token"))
+
+	return request, payload, nil
+}
+
+func (t haRestTarget) Execute(ctx context.Context, command Command) (Result, error) {
+	b := t.bot
+	service, data, err := b.serviceCall(command)
+	if err != nil {
+		return Result{}, err
+	}
+
+	responseBody, err := b.callService(ctx, service, data)
+	return Result{Body: responseBody}, err
+}
+
+// callService calls a Home Assistant service and returns the response body,
+// which lists the states changed by the call.
+func (b *Bot) callService(ctx context.Context, service string, data map[string]any) ([]byte, error) {
+	request, _, err := b.newServiceRequest(ctx, service, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkOutboundURL(request.URL.String()); err != nil {
+		log.Printf("[REST]          Refusing to call %s: %s", service, err)
+		return nil, err
+	}
+
+	resp, err := b.webhookClient.Do(request)
+	if err != nil {
+		callErr := classifyRequestError(err)
+		log.Printf("[REST]          Calling %s failed (%s): %s", service, callErr.Kind, err)
+		return nil, callErr
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseSize))
+	if err != nil {
+		log.Printf("[REST]          Error reading response: %s", err)
+	}
+
+	if err := classifyStatus(resp.StatusCode); err != nil {
+		log.Printf("[REST]          Calling %s failed with status code: %d", service, resp.StatusCode)
+		return responseBody, err
+	}
+
+	log.Printf("[REST]          Calling %s was successful!", service)
+	return responseBody, nil
+}
+
+// serviceSummary describes the states changed by a service call.
+func serviceSummary(service string, responseBody []byte) string {
+	var states []struct {
+		EntityId string `json:"entity_id"`
+		State    string `json:"state"`
+	}
+	if json.Unmarshal(responseBody, &states) != nil || len(states) == 0 {
+		return fmt.Sprintf("Called %s, no states changed", service)
+	}
+
+	changed := make([]string, 0, len(states))
+	for _, state := range states {
+		changed = append(changed, fmt.Sprintf("%s (%s)", state.EntityId, state.State))
+	}
+
+	return fmt.Sprintf("Called %s, changed: %s", service, strings.Join(changed, ", "))
+}
+
+func (t haRestTarget) Preview(command Command) (*http.Request, []byte, error) {
+	b := t.bot
+	service, data, err := b.serviceCall(command)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b.newServiceRequest(context.Background(), service, data)
+}
@@ -0,0 +1,18 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServiceCallErrorDoesntMention(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.target_type": "ha_rest"})
+
+	_, _, err := b.serviceCall(Command{Name: "turn_on", Args: []string{"hi @all"}})
+	if err == nil {
+		t.Fatal("serviceCall succeeded, want error")
+	}
+	if strings.Contains(err.Error(), "@all") {
+		t.Errorf("error %q mentions @all", err)
+	}
+}
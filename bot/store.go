@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store remembers keys for a limited time. It backs the replay and dedupe
+// checks, so several instances of the bot can share their state via Redis.
+type Store interface {
+	// Seen marks key as seen for ttl and reports whether it already was.
+	Seen(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Forget removes key, so it is not seen anymore.
+	Forget(ctx context.Context, key string) error
+}
+
+// newStore returns a Redis store when bot.redis.url is set and an in-memory
+// store otherwise.
+func (b *Bot) newStore() (Store, error) {
+	redisURL := b.config.GetString("bot.redis.url")
+	if redisURL == "" {
+		return NewMemoryStore(), nil
+	}
+
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+
+	return &redisStore{client: client, prefix: b.config.GetString("bot.redis.prefix")}, nil
+}
+
+type memoryStore struct {
+	mu        sync.Mutex
+	expiries  map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewMemoryStore returns a Store keeping its keys in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{expiries: make(map[string]time.Time)}
+}
+
+func (s *memoryStore) Seen(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) > time.Minute {
+		for k, expiry := range s.expiries {
+			if now.After(expiry) {
+				delete(s.expiries, k)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	if expiry, ok := s.expiries[key]; ok && now.Before(expiry) {
+		return true, nil
+	}
+	s.expiries[key] = now.Add(ttl)
+
+	return false, nil
+}
+
+func (s *memoryStore) Forget(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.expiries, key)
+	return nil
+}
+
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func (s *redisStore) Seen(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	// SET NX only succeeds for keys which don't exist yet
+	added, err := s.client.SetNX(ctx, s.prefix+key, 1, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return !added, nil
+}
+
+func (s *redisStore) Forget(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+key).Err()
+}
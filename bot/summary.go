@@ -0,0 +1,53 @@
+package bot
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+// logLevels are the values accepted for bot.log_level, most verbose first.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// redacted shows whether a secret is set without revealing it.
+func redacted(value string) string {
+	if value == "" {
+		return "(not set)"
+	}
+
+	return "(set)"
+}
+
+// LogSummary logs the effective configuration, with secrets redacted, so a
+// deployment can be verified at a glance. It is skipped when bot.log_level is
+// warn or error.
+func (b *Bot) LogSummary() {
+	switch b.config.GetString("bot.log_level") {
+	case "warn", "error":
+		return
+	}
+
+	cfg := b.config
+	log.Printf("[Config]        Port:                  %d", cfg.GetInt("bot.port"))
+	log.Printf("[Config]        Trigger:               %s", b.triggerPrefix)
+	log.Printf("[Config]        Secret:                %s", redacted(cfg.GetString("bot.secret")))
+	log.Printf("[Config]        Target:                %s", cfg.GetString("bot.target_type"))
+	haURL := b.haBaseURL()
+	if parsed, err := url.Parse(haURL); err == nil {
+		// Hides a password in the URL
+		haURL = parsed.Redacted()
+	}
+	log.Printf("[Config]        Home Assistant URL:    %s", haURL)
+	if cfg.GetString("bot.target_type") == "ha_rest" {
+		log.Printf("[Config]        Token:                 %s", redacted(cfg.GetString("bot.ha.token")))
+	} else {
+		log.Printf("[Config]        Webhook id:            %s", redacted(cfg.GetString("bot.ha.webhook_id")))
+		log.Printf("[Config]        Method:                %s", strings.ToUpper(cfg.GetString("bot.ha.method")))
+		log.Printf("[Config]        Signing secret:        %s", redacted(cfg.GetString("bot.ha.signing_secret")))
+	}
+	log.Printf("[Config]        Maintenance:           %t", b.maintenanceMode.Load())
+	log.Printf("[Config]        Allowed conversations: %d (0 allows all)", len(cfg.GetStringSlice("bot.allowed_conversations")))
+	log.Printf("[Config]        Admins:                %d", len(cfg.GetStringSlice("bot.admins")))
+	log.Printf("[Config]        Commands:              %d", len(cfg.GetStringMap("bot.commands")))
+	log.Printf("[Config]        Workers:               %d (queue of %d)", cfg.GetInt("bot.workers"), cfg.GetInt("bot.queue_size"))
+}
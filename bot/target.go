@@ -0,0 +1,130 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrTargetFailed is matched by every CallError, for callers which don't care
+// why the call failed.
+var ErrTargetFailed = errors.New("target call failed")
+
+// FailureKind classifies why a call to Home Assistant failed.
+type FailureKind string
+
+const (
+	FailureDNS               FailureKind = "dns"
+	FailureConnectionRefused FailureKind = "connection refused"
+	FailureTimeout           FailureKind = "timeout"
+	FailureNetwork           FailureKind = "network"
+	FailureBlockedAddress    FailureKind = "blocked address"
+	FailureClientError       FailureKind = "client error"
+	FailureServerError       FailureKind = "server error"
+	FailureUnexpectedStatus  FailureKind = "unexpected status"
+)
+
+// CallError describes a failed call to Home Assistant. StatusCode is only set
+// when Home Assistant answered.
+type CallError struct {
+	Kind       FailureKind
+	StatusCode int
+	Err        error
+}
+
+func (e *CallError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: status code %d", e.Kind, e.StatusCode)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CallError) Is(target error) bool {
+	return target == ErrTargetFailed
+}
+
+// Temporary reports whether the same call may succeed when retried.
+func (e *CallError) Temporary() bool {
+	switch e.Kind {
+	case FailureConnectionRefused, FailureTimeout, FailureNetwork, FailureServerError:
+		return true
+	}
+
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// classifyRequestError wraps an error returned by http.Client.Do.
+func classifyRequestError(err error) *CallError {
+	var dnsError *net.DNSError
+	var netError net.Error
+	switch {
+	case errors.Is(err, errBlockedAddress):
+		return &CallError{Kind: FailureBlockedAddress, Err: err}
+	case errors.As(err, &dnsError) && !dnsError.IsTimeout:
+		return &CallError{Kind: FailureDNS, Err: err}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return &CallError{Kind: FailureConnectionRefused, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netError) && netError.Timeout():
+		return &CallError{Kind: FailureTimeout, Err: err}
+	}
+
+	return &CallError{Kind: FailureNetwork, Err: err}
+}
+
+// classifyStatus returns an error for any status code but 200.
+func classifyStatus(statusCode int) error {
+	switch {
+	case statusCode == http.StatusOK:
+		return nil
+	case statusCode >= 400 && statusCode < 500:
+		return &CallError{Kind: FailureClientError, StatusCode: statusCode}
+	case statusCode >= 500:
+		return &CallError{Kind: FailureServerError, StatusCode: statusCode}
+	}
+
+	return &CallError{Kind: FailureUnexpectedStatus, StatusCode: statusCode}
+}
+
+// Target executes commands in an automation system. Other backends can be
+// added by implementing it and selecting them via bot.target_type.
+type Target interface {
+	Execute(ctx context.Context, command Command) (Result, error)
+}
+
+// previewer is implemented by targets which can show the request a command
+// would be sent as, for the test subcommand.
+type previewer interface {
+	Preview(command Command) (*http.Request, []byte, error)
+}
+
+// Result is the outcome of an executed command.
+type Result struct {
+	// Body is the response of the target, if any
+	Body []byte
+	// Fallback is set when the command was sent to a fallback
+	Fallback bool
+	// Summary describes the outcome of a command sent to several webhooks
+	Summary string
+}
+
+// targetTypes are the values accepted for bot.target_type.
+var targetTypes = []string{"ha_webhook", "ha_rest"}
+
+func (b *Bot) newTarget(targetType string) (Target, error) {
+	switch targetType {
+	case "ha_webhook":
+		return haWebhookTarget{bot: b}, nil
+	case "ha_rest":
+		return haRestTarget{bot: b}, nil
+	}
+
+	return nil, fmt.Errorf("unknown target type %q", targetType)
+}
@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantKind      FailureKind
+		wantTemporary bool
+	}{
+		{http.StatusNoContent, FailureUnexpectedStatus, false},
+		{http.StatusBadRequest, FailureClientError, false},
+		{http.StatusNotFound, FailureClientError, false},
+		{http.StatusTooManyRequests, FailureClientError, true},
+		{http.StatusInternalServerError, FailureServerError, true},
+		{http.StatusBadGateway, FailureServerError, true},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			server, _ := newTestHomeAssistant(t, test.status)
+			b := newTestBot(t, map[string]any{"bot.ha.url": server.URL})
+
+			_, err := b.callWebhook(context.Background(), b.webhookURL(), http.MethodPost, []byte(`{}`))
+
+			var callErr *CallError
+			if !errors.As(err, &callErr) {
+				t.Fatalf("callWebhook = %v, want a *CallError", err)
+			}
+			if callErr.Kind != test.wantKind || callErr.StatusCode != test.status {
+				t.Errorf("error = %s, want %s with status code %d", callErr, test.wantKind, test.status)
+			}
+			if callErr.Temporary() != test.wantTemporary {
+				t.Errorf("Temporary() = %t, want %t", callErr.Temporary(), test.wantTemporary)
+			}
+			if !errors.Is(err, ErrTargetFailed) {
+				t.Errorf("errors.Is(%v, ErrTargetFailed) = false", err)
+			}
+		})
+	}
+
+	server, _ := newTestHomeAssistant(t, http.StatusOK)
+	b := newTestBot(t, map[string]any{"bot.ha.url": server.URL})
+	if _, err := b.callWebhook(context.Background(), b.webhookURL(), http.MethodPost, []byte(`{}`)); err != nil {
+		t.Errorf("callWebhook with status 200 = %v, want no error", err)
+	}
+}
+
+func TestClassifyConnectionRefused(t *testing.T) {
+	server, _ := newTestHomeAssistant(t, http.StatusOK)
+	server.Close()
+	b := newTestBot(t, map[string]any{"bot.ha.url": server.URL})
+
+	_, err := b.callWebhook(context.Background(), b.webhookURL(), http.MethodPost, []byte(`{}`))
+
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Kind != FailureConnectionRefused {
+		t.Errorf("callWebhook = %v, want %s", err, FailureConnectionRefused)
+	}
+}
+
+func TestClassifyTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	b := newTestBot(t, map[string]any{"bot.ha.url": server.URL, "bot.ha.timeout": 20 * time.Millisecond})
+
+	_, err := b.callWebhook(context.Background(), b.webhookURL(), http.MethodPost, []byte(`{}`))
+
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Kind != FailureTimeout || !callErr.Temporary() {
+		t.Errorf("callWebhook = %v, want a temporary %s", err, FailureTimeout)
+	}
+}
+
+func TestClassifyRequestError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want FailureKind
+	}{
+		{"dns", &net.DNSError{Err: "no such host", Name: "homeassistant", IsNotFound: true}, FailureDNS},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "homeassistant", IsTimeout: true}, FailureTimeout},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, FailureConnectionRefused},
+		{"deadline", fmt.Errorf("request: %w", context.DeadlineExceeded), FailureTimeout},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, FailureNetwork},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			callErr := classifyRequestError(test.err)
+			if callErr.Kind != test.want {
+				t.Errorf("classifyRequestError(%v) = %s, want %s", test.err, callErr.Kind, test.want)
+			}
+			if !errors.Is(callErr, test.err) {
+				t.Errorf("classifyRequestError(%v) doesn't wrap the error", test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// telemetryEvent is posted to bot.telemetry.webhook for every command sent to
+// Home Assistant. It never holds the message, arguments or any secret.
+type telemetryEvent struct {
+	Time         time.Time `json:"time"`
+	Conversation string    `json:"conversation"`
+	Command      string    `json:"command"`
+	Outcome      string    `json:"outcome"`
+	LatencyMs    int64     `json:"latency_ms"`
+	TotalMs      int64     `json:"total_ms"`
+}
+
+// commandOutcome names the outcome of a command for telemetry.
+func commandOutcome(err error) string {
+	var callErr *CallError
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &callErr):
+		return string(callErr.Kind)
+	case errors.Is(err, ErrTargetFailed):
+		return "failed"
+	}
+
+	return "rejected"
+}
+
+// sendTelemetry posts an event to bot.telemetry.webhook in the background, so
+// a slow or unreachable endpoint never delays commands. Failures are only
+// logged.
+func (b *Bot) sendTelemetry(event telemetryEvent) {
+	webhook := b.config.GetString("bot.telemetry.webhook")
+	if webhook == "" {
+		return
+	}
+
+	go func() {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.config.GetDuration("bot.telemetry.timeout"))
+		defer cancel()
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[Telemetry]     Error creating request: %s", err)
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			log.Printf("[Telemetry]     Error posting event: %s", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("[Telemetry]     Error posting event, status code %d", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,200 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// varCommands manage the vars of a conversation. They can be used by everyone,
+// unless bot.vars_admins_only restricts set and unset to bot.admins.
+var varCommands = []string{"set", "unset", "vars"}
+
+var varNameRegex = regexp.MustCompile(`^\w+$`)
+
+// conversationVars returns the vars of a conversation which did not expire.
+func (b *Bot) conversationVars(token string) map[string]string {
+	b.conversations.mu.Lock()
+	defer b.conversations.mu.Unlock()
+
+	b.conversations.prune(time.Now())
+	vars := make(map[string]string)
+	if state, ok := b.conversations.states[token]; ok {
+		for key, variable := range state.vars {
+			vars[key] = variable.Value
+		}
+	}
+
+	return vars
+}
+
+// setVar sets a var of a conversation for bot.vars_ttl. A conversation holds
+// at most bot.vars_max vars.
+func (b *Bot) setVar(token string, key string, value string) error {
+	b.conversations.mu.Lock()
+	defer b.conversations.mu.Unlock()
+
+	now := time.Now()
+	b.conversations.prune(now)
+	state := b.conversations.get(token)
+	if _, exists := state.vars[key]; !exists && len(state.vars) >= b.config.GetInt("bot.vars_max") {
+		return fmt.Errorf("at most %d vars can be set, unset one first", b.config.GetInt("bot.vars_max"))
+	}
+	if state.vars == nil {
+		state.vars = make(map[string]conversationVar)
+	}
+	state.vars[key] = conversationVar{Value: value, Expires: now.Add(b.config.GetDuration("bot.vars_ttl"))}
+
+	return b.saveVars()
+}
+
+// unsetVar removes a var of a conversation and reports whether it was set.
+func (b *Bot) unsetVar(token string, key string) (bool, error) {
+	b.conversations.mu.Lock()
+	defer b.conversations.mu.Unlock()
+
+	state, ok := b.conversations.states[token]
+	if !ok {
+		return false, nil
+	}
+	if _, ok := state.vars[key]; !ok {
+		return false, nil
+	}
+	delete(state.vars, key)
+	b.conversations.prune(time.Now())
+
+	return true, b.saveVars()
+}
+
+// saveVars writes the vars of all conversations to bot.vars_file, if set. The
+// caller must hold b.conversations.mu.
+func (b *Bot) saveVars() error {
+	path := b.config.GetString("bot.vars_file")
+	if path == "" {
+		return nil
+	}
+
+	saved := make(map[string]map[string]conversationVar)
+	for token, state := range b.conversations.states {
+		if len(state.vars) > 0 {
+			saved[token] = state.vars
+		}
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// Replacing the file keeps it intact if writing fails halfway
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// loadVars reads the vars saved to bot.vars_file. A missing file is not an
+// error, as it is created when the first var is set.
+func (b *Bot) loadVars() error {
+	path := b.config.GetString("bot.vars_file")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var saved map[string]map[string]conversationVar
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	b.conversations.mu.Lock()
+	defer b.conversations.mu.Unlock()
+
+	for token, vars := range saved {
+		b.conversations.get(token).vars = vars
+	}
+	b.conversations.prune(time.Now())
+
+	return nil
+}
+
+// varsCommandReply handles "@ha set <name> <value>", "@ha unset <name>" and
+// "@ha vars" and returns the reply.
+func (b *Bot) varsCommandReply(job commandJob, command Command) string {
+	token := job.message.Target.Id
+
+	switch command.Name {
+	case "set":
+		if len(command.Args) < 2 || !varNameRegex.MatchString(command.Args[0]) {
+			return "Usage: set <name> <value>"
+		}
+		value := strings.Join(command.Args[1:], " ")
+		if err := b.setVar(token, command.Args[0], value); err != nil {
+			log.Printf("[Talk]          Error setting var %s: %s", command.Args[0], err)
+			return "Error: " + err.Error()
+		}
+		return fmt.Sprintf("%s is now %s", command.Args[0], neutralizeText(value, maxEchoLength))
+	case "unset":
+		if len(command.Args) != 1 {
+			return "Usage: unset <name>"
+		}
+		removed, err := b.unsetVar(token, command.Args[0])
+		if err != nil {
+			log.Printf("[Talk]          Error unsetting var %s: %s", command.Args[0], err)
+			return "Error: " + err.Error()
+		} else if !removed {
+			return neutralizeText(command.Args[0], maxEchoLength) + " is not set"
+		}
+		return command.Args[0] + " is unset"
+	}
+
+	vars := b.conversationVars(token)
+	if len(vars) == 0 {
+		return "No vars set"
+	}
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		// Values are user input, which must not mention anyone when listed
+		lines = append(lines, key+" = "+neutralizeText(vars[key], maxEchoLength))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// handleVarsCommand handles the varCommands and reports whether the command
+// was one of them.
+func (b *Bot) handleVarsCommand(ctx context.Context, job commandJob, command Command) bool {
+	if !slices.Contains(varCommands, command.Name) {
+		return false
+	}
+
+	if command.Name != "vars" && b.config.GetBool("bot.vars_admins_only") && !b.isAdmin(job.message.Actor) {
+		log.Printf("[Talk]          %s is not allowed to use %s", job.message.Actor.Id, command.Name)
+		b.sendReply(ctx, job.server, job.message, "You are not allowed to use this command")
+		return true
+	}
+
+	b.sendReply(ctx, job.server, job.message, b.varsCommandReply(job, command))
+	return true
+}
@@ -0,0 +1,26 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVarsRepliesDontMention(t *testing.T) {
+	b := newTestBot(t, nil)
+	job := commandJob{message: Message{Target: MessageTarget{Id: "token"}}}
+
+	replies := []string{
+		b.varsCommandReply(job, Command{Name: "set", Args: []string{"who", "@all"}}),
+		b.varsCommandReply(job, Command{Name: "vars"}),
+		b.varsCommandReply(job, Command{Name: "unset", Args: []string{"@all"}}),
+	}
+	for _, reply := range replies {
+		if strings.Contains(reply, "@all") {
+			t.Errorf("reply %q mentions @all", reply)
+		}
+	}
+
+	if got := b.conversationVars("token")["who"]; got != "@all" {
+		t.Errorf("var who = %q, want it stored unchanged as %q", got, "@all")
+	}
+}
@@ -0,0 +1,291 @@
+package bot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fallbackKinds are the failures for which the fallback webhook is called,
+// as Home Assistant couldn't handle the command. A client error or an
+// unexpected status would likely be the same on the fallback.
+var fallbackKinds = []FailureKind{FailureDNS, FailureConnectionRefused, FailureNetwork, FailureTimeout, FailureServerError}
+
+// haWebhookTarget calls a Home Assistant webhook automation. It is the default target.
+type haWebhookTarget struct {
+	bot *Bot
+}
+
+func (t haWebhookTarget) Execute(ctx context.Context, command Command) (Result, error) {
+	b := t.bot
+	payload, err := b.buildPayload(command)
+	if err != nil {
+		return Result{}, err
+	}
+
+	method := b.webhookMethod(command)
+	if webhookIds := b.config.GetStringSlice("bot.commands." + command.Name + ".webhook_ids"); len(webhookIds) > 0 {
+		return b.fanOut(ctx, webhookIds, b.config.GetStringSlice("bot.commands."+command.Name+".webhook_labels"), method, payload)
+	}
+
+	responseBody, err := b.callWebhook(ctx, b.webhookURL(), method, payload)
+
+	var callErr *CallError
+	if fallbackURL := b.fallbackWebhookURL(); fallbackURL != "" && errors.As(err, &callErr) && slices.Contains(fallbackKinds, callErr.Kind) {
+		log.Printf("[Webhook]       Trying fallback webhook")
+		responseBody, err = b.callWebhook(ctx, fallbackURL, method, payload)
+		return Result{Body: responseBody, Fallback: true}, err
+	}
+
+	return Result{Body: responseBody}, err
+}
+
+func (t haWebhookTarget) Preview(command Command) (*http.Request, []byte, error) {
+	b := t.bot
+	payload, err := b.buildPayload(command)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request, err := b.newWebhookRequest(context.Background(), b.webhookURL(), b.webhookMethod(command), payload)
+	return request, payload, err
+}
+
+// newWebhookClient creates the client used for all calls to Home Assistant, so
+// a hung connection can't block a worker forever. It refuses to connect to
+// blocked addresses.
+func (b *Bot) newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: b.config.GetDuration("bot.ha.dial_timeout"),
+		Control: checkDialAddress,
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: b.config.GetDuration("bot.ha.tls_handshake_timeout"),
+	}
+
+	return &http.Client{
+		Timeout:   b.config.GetDuration("bot.ha.timeout"),
+		Transport: transport,
+	}
+}
+
+// haBaseURL returns bot.ha.url without trailing slashes.
+func (b *Bot) haBaseURL() string {
+	return strings.TrimRight(b.config.GetString("bot.ha.url"), "/")
+}
+
+func (b *Bot) webhookURL() string {
+	return b.haBaseURL() + "/api/webhook/" + b.config.GetString("bot.ha.webhook_id")
+}
+
+// fallbackWebhookURL is called when the webhook can't be reached or fails with
+// a server error. It is empty unless bot.ha.fallback_webhook_id is set, and
+// points to bot.ha.fallback_url, or bot.ha.url when that is not set.
+func (b *Bot) fallbackWebhookURL() string {
+	webhookId := b.config.GetString("bot.ha.fallback_webhook_id")
+	if webhookId == "" {
+		return ""
+	}
+
+	baseURL := strings.TrimRight(b.config.GetString("bot.ha.fallback_url"), "/")
+	if baseURL == "" {
+		baseURL = b.haBaseURL()
+	}
+
+	return baseURL + "/api/webhook/" + webhookId
+}
+
+// signWebhookRequest adds an HMAC of the body (or query for GET) when
+// bot.ha.signing_secret is set, so Home Assistant can verify the call came from
+// the bot. With bot.ha.signing_nonce the HMAC covers a random nonce followed by
+// the body, just like the signature of Talk requests.
+func (b *Bot) signWebhookRequest(request *http.Request, body []byte) {
+	secret := b.config.GetString("bot.ha.signing_secret")
+	if secret == "" {
+		return
+	}
+
+	random := ""
+	if b.config.GetBool("bot.ha.signing_nonce") {
+		random = generateRandomBytes(64)
+		request.Header.Set(b.config.GetString("bot.ha.signing_random_header"), random)
+	}
+
+	request.Header.Set(b.config.GetString("bot.ha.signing_header"), GenerateHmacForString(string(body), random, secret))
+}
+
+// webhookMethod returns the HTTP method configured for a command, falling back
+// to bot.ha.method.
+func (b *Bot) webhookMethod(command Command) string {
+	if method := b.config.GetString("bot.commands." + command.Name + ".method"); method != "" {
+		return strings.ToUpper(method)
+	}
+
+	return strings.ToUpper(b.config.GetString("bot.ha.method"))
+}
+
+// payloadToQuery encodes the top level fields of a JSON object as query
+// parameters. Strings are used as they are, all other values JSON encoded.
+func payloadToQuery(jsonData []byte) (url.Values, error) {
+	query := url.Values{}
+	if len(jsonData) == 0 {
+		return query, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jsonData, &fields); err != nil {
+		return nil, err
+	}
+
+	for key, raw := range fields {
+		var text string
+		if json.Unmarshal(raw, &text) == nil {
+			query.Set(key, text)
+		} else {
+			query.Set(key, string(raw))
+		}
+	}
+
+	return query, nil
+}
+
+// gzipBytes compresses data with gzip.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// newWebhookRequest builds the signed webhook request. For GET the payload is
+// sent as query parameters, otherwise as JSON body, which is gzip compressed
+// from bot.ha.compress_threshold bytes on when bot.ha.compress is set. The
+// signature always covers the uncompressed body.
+func (b *Bot) newWebhookRequest(ctx context.Context, requestURL string, method string, jsonData []byte) (*http.Request, error) {
+	signed := jsonData
+
+	var body io.Reader
+	compressed := false
+	if method == http.MethodGet {
+		query, err := payloadToQuery(jsonData)
+		if err != nil {
+			return nil, fmt.Errorf("encoding query: %w", err)
+		}
+		signed = []byte(query.Encode())
+		requestURL += "?" + query.Encode()
+	} else if b.config.GetBool("bot.ha.compress") && len(jsonData) >= b.config.GetInt("bot.ha.compress_threshold") {
+		gzipped, err := gzipBytes(jsonData)
+		if err != nil {
+			return nil, fmt.Errorf("compressing body: %w", err)
+		}
+		body = bytes.NewReader(gzipped)
+		compressed = true
+	} else {
+		body = bytes.NewReader(jsonData)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if compressed {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	b.signWebhookRequest(request, signed)
+
+	return request, nil
+}
+
+// callWebhook sends the payload to Home Assistant and returns the response
+// body. A failed call returns a *CallError telling why it failed.
+func (b *Bot) callWebhook(ctx context.Context, requestURL string, method string, jsonData []byte) ([]byte, error) {
+	if err := b.checkOutboundURL(requestURL); err != nil {
+		log.Printf("[Webhook]       Refusing to call webhook: %s", err)
+		return nil, err
+	}
+
+	request, err := b.newWebhookRequest(ctx, requestURL, method, jsonData)
+	if err != nil {
+		log.Printf("[Webhook]       Error creating request: %s", err)
+		return nil, err
+	}
+
+	resp, err := b.webhookClient.Do(request)
+	if err != nil {
+		callErr := classifyRequestError(err)
+		log.Printf("[Webhook]       %s request failed (%s): %s", method, callErr.Kind, err)
+		return nil, callErr
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseSize))
+	if err != nil {
+		log.Printf("[Webhook]       Error reading response: %s", err)
+	}
+
+	// Check the response
+	if err := classifyStatus(resp.StatusCode); err != nil {
+		log.Printf("[Webhook]       %s request failed with status code: %s", method, strconv.Itoa(resp.StatusCode))
+		return responseBody, err
+	}
+
+	log.Printf("[Webhook]       %s request was successful!", method)
+	return responseBody, nil
+}
+
+// failedTargets reads the list at the dotted path (e.g. "result.failed") from a
+// webhook response. ok is false when the response has no such list.
+func failedTargets(responseBody []byte, path string) (failed []string, ok bool) {
+	var value any
+	if path == "" || json.Unmarshal(responseBody, &value) != nil {
+		return nil, false
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		object, isObject := value.(map[string]any)
+		if !isObject {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+
+	list, isList := value.([]any)
+	if !isList {
+		return nil, false
+	}
+
+	for _, item := range list {
+		if text, isString := item.(string); isString {
+			failed = append(failed, text)
+		} else {
+			encoded, _ := json.Marshal(item)
+			failed = append(failed, string(encoded))
+		}
+	}
+
+	return failed, true
+}
@@ -0,0 +1,190 @@
+package bot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// receivedRequest is a request received by a test server.
+type receivedRequest struct {
+	method string
+	query  string
+	header http.Header
+	body   []byte
+}
+
+// newTestHomeAssistant starts a server answering every request with status and
+// recording it on the returned channel.
+func newTestHomeAssistant(t *testing.T, status int) (*httptest.Server, chan receivedRequest) {
+	t.Helper()
+
+	received := make(chan receivedRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedRequest{method: r.Method, query: r.URL.RawQuery, header: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, received
+}
+
+func TestPayloadToQuery(t *testing.T) {
+	query, err := payloadToQuery([]byte(`{"action":"brightness","target":"kitchen","args":[128,"fast"],"named":{"level":"5"}}`))
+	if err != nil {
+		t.Fatalf("payloadToQuery: %s", err)
+	}
+
+	want := "action=brightness&args=%5B128%2C%22fast%22%5D&named=%7B%22level%22%3A%225%22%7D&target=kitchen"
+	if got := query.Encode(); got != want {
+		t.Errorf("query = %s, want %s", got, want)
+	}
+
+	if _, err := payloadToQuery([]byte(`["not", "an", "object"]`)); err == nil {
+		t.Error("payloadToQuery of a list succeeded, want error")
+	}
+}
+
+func TestWebhookMethods(t *testing.T) {
+	payload := `{"action":"turn_on","target":"kitchen"}`
+
+	tests := []struct {
+		method    string
+		wantQuery string
+		wantBody  string
+	}{
+		{http.MethodGet, "action=turn_on&target=kitchen", ""},
+		{http.MethodPost, "", payload},
+		{http.MethodPut, "", payload},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			server, received := newTestHomeAssistant(t, http.StatusOK)
+			b := newTestBot(t, map[string]any{"bot.ha.url": server.URL, "bot.ha.method": test.method})
+
+			if _, err := b.callWebhook(context.Background(), b.webhookURL(), b.webhookMethod(Command{}), []byte(payload)); err != nil {
+				t.Fatalf("callWebhook: %s", err)
+			}
+
+			request := <-received
+			if request.method != test.method {
+				t.Errorf("method = %s, want %s", request.method, test.method)
+			}
+			if request.query != test.wantQuery {
+				t.Errorf("query = %q, want %q", request.query, test.wantQuery)
+			}
+			if string(request.body) != test.wantBody {
+				t.Errorf("body = %q, want %q", request.body, test.wantBody)
+			}
+			if got, want := request.header.Get("Content-Type") != "", test.wantBody != ""; got != want {
+				t.Errorf("Content-Type = %q, want it set only with a body", request.header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestWebhookCompression(t *testing.T) {
+	small := `{"action":"turn_on","target":"kitchen"}`
+	large := `{"action":"notify","target":"` + strings.Repeat("all lights are on ", 100) + `"}`
+
+	tests := []struct {
+		name         string
+		payload      string
+		wantEncoding string
+	}{
+		{"below threshold", small, ""},
+		{"above threshold", large, "gzip"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, received := newTestHomeAssistant(t, http.StatusOK)
+			b := newTestBot(t, map[string]any{
+				"bot.ha.url":                server.URL,
+				"bot.ha.compress":           true,
+				"bot.ha.compress_threshold": 1024,
+				"bot.ha.signing_secret":     "signing",
+			})
+
+			if _, err := b.callWebhook(context.Background(), b.webhookURL(), http.MethodPost, []byte(test.payload)); err != nil {
+				t.Fatalf("callWebhook: %s", err)
+			}
+
+			request := <-received
+			if got := request.header.Get("Content-Encoding"); got != test.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, test.wantEncoding)
+			}
+
+			body := request.body
+			if test.wantEncoding == "gzip" {
+				if len(body) >= len(test.payload) {
+					t.Errorf("compressed body has %d bytes, want less than %d", len(body), len(test.payload))
+				}
+				reader, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %s", err)
+				}
+				if body, err = io.ReadAll(reader); err != nil {
+					t.Fatalf("decompressing: %s", err)
+				}
+			}
+			if string(body) != test.payload {
+				t.Errorf("body = %q, want %q", body, test.payload)
+			}
+
+			// The signature covers the uncompressed body
+			if got, want := request.header.Get("X-Signature"), GenerateHmacForString(test.payload, "", "signing"); got != want {
+				t.Errorf("X-Signature = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFallbackWebhook(t *testing.T) {
+	fallback, fallbackRequests := newTestHomeAssistant(t, http.StatusOK)
+
+	tests := []struct {
+		status       int
+		wantFallback bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusNotFound, false},
+		{http.StatusNoContent, false},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			primary, primaryRequests := newTestHomeAssistant(t, test.status)
+			b := newTestBot(t, map[string]any{
+				"bot.ha.url":                 primary.URL,
+				"bot.ha.fallback_url":        fallback.URL,
+				"bot.ha.fallback_webhook_id": "fallback",
+			})
+
+			result, err := haWebhookTarget{bot: b}.Execute(context.Background(), Command{Name: "turn_on", Args: []string{"kitchen"}})
+			if len(primaryRequests) != 1 {
+				t.Errorf("%d requests to the primary webhook, want 1", len(primaryRequests))
+			}
+			if got := len(fallbackRequests); test.wantFallback != (got == 1) {
+				t.Errorf("%d requests to the fallback webhook, want fallback %t", got, test.wantFallback)
+			}
+			for len(fallbackRequests) > 0 {
+				<-fallbackRequests
+			}
+
+			if result.Fallback != test.wantFallback {
+				t.Errorf("result.Fallback = %t, want %t", result.Fallback, test.wantFallback)
+			}
+			if test.wantFallback && err != nil {
+				t.Errorf("Execute = %s, want no error", err)
+			}
+			if !test.wantFallback && err == nil {
+				t.Error("Execute succeeded, want the error of the primary webhook")
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const maxEchoLength = 100
+
+// commandJob is a validated command waiting to be sent to Home Assistant.
+type commandJob struct {
+	server      string
+	message     Message
+	richMessage RichObjectMessageWithParameters
+	command     Command
+	parseErr    error
+	// bareMention is set when the bot was mentioned without a command
+	bareMention bool
+	received    time.Time
+}
+
+// startWorkers starts n workers processing queued commands.
+func (b *Bot) startWorkers(n int, queueSize int) {
+	n = max(n, 1)
+	queueSize = max(queueSize, 0)
+
+	b.commandQueue = make(chan commandJob, queueSize)
+	for i := 0; i < n; i++ {
+		b.workers.Add(1)
+		go func() {
+			defer b.workers.Done()
+			for job := range b.commandQueue {
+				b.processCommandSafely(job)
+			}
+		}()
+	}
+	log.Printf("[Worker]        Started %d workers (queue size %d)", n, queueSize)
+}
+
+// Drain waits until all queued commands are processed and their replies,
+// including debounced ones, are sent. The handler must not be used afterwards.
+func (b *Bot) Drain() {
+	if b.commandQueue == nil {
+		return
+	}
+	close(b.commandQueue)
+	b.workers.Wait()
+
+	b.pendingReplies.mu.Lock()
+	tokens := make([]string, 0, len(b.pendingReplies.pending))
+	for token := range b.pendingReplies.pending {
+		tokens = append(tokens, token)
+	}
+	b.pendingReplies.mu.Unlock()
+
+	for _, token := range tokens {
+		b.flushReplies(token)
+	}
+}
+
+// enqueueCommand queues a job without blocking and reports whether it was queued.
+func (b *Bot) enqueueCommand(job commandJob) bool {
+	select {
+	case b.commandQueue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// processCommandSafely processes a job and logs a panic instead of crashing the
+// bot, so the worker goes on with the next job.
+func (b *Bot) processCommandSafely(job commandJob) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("[Worker]        PANIC processing %q: %v\n%s", job.richMessage.Message, err, debug.Stack())
+		}
+	}()
+
+	b.processCommand(job)
+}
+
+// processCommand calls Home Assistant and reports the outcome as a chat reply.
+func (b *Bot) processCommand(job commandJob) {
+	// A single deadline covers calling Home Assistant and replying, so a
+	// command can't occupy the worker for the sum of all timeouts
+	ctx := context.Background()
+	if deadline := b.config.GetDuration("bot.total_deadline"); deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+
+	if job.bareMention {
+		b.sendReply(ctx, job.server, job.message, fmt.Sprintf("Hi! Send %s help to see what I can do.", b.triggerPrefix))
+		return
+	}
+
+	if job.parseErr != nil {
+		log.Printf("[Talk]          Error parsing command: %s", job.parseErr)
+		b.sendReply(ctx, job.server, job.message, b.echoCommand(job, "Error: "+job.parseErr.Error()))
+		return
+	}
+
+	if b.handleBuiltinCommand(ctx, job, job.command) || b.handleVarsCommand(ctx, job, job.command) || b.handlePingCommand(ctx, job, job.command) || b.handleHelpCommand(ctx, job, job.command) {
+		return
+	}
+
+	token := job.message.Target.Id
+	if job.command.Name == "retry" && len(job.command.Args) == 0 && len(job.command.Named) == 0 {
+		failed, ok := b.failedCommand(token)
+		if !ok {
+			b.sendReply(ctx, job.server, job.message, "Nothing to retry")
+			return
+		}
+		log.Printf("[Talk]          Retrying command: %s", failed.Text)
+		job.command = failed
+	}
+	job.command.Vars = b.conversationVars(token)
+
+	if b.maintenanceMode.Load() {
+		log.Printf("[Talk]          Maintenance mode, skipping command: %s", job.richMessage.Message)
+		b.sendReply(ctx, job.server, job.message, b.config.GetString("bot.maintenance_message"))
+		return
+	}
+
+	if b.config.GetBool("bot.ack_processing") {
+		b.sendProcessingAck(ctx, job)
+	}
+
+	webhookStart := time.Now()
+	reply, err := b.commandReply(ctx, job)
+	webhookDuration := time.Since(webhookStart)
+
+	// Only commands which didn't reach Home Assistant are worth retrying
+	if errors.Is(err, ErrTargetFailed) || errors.Is(err, context.DeadlineExceeded) {
+		b.rememberFailed(token, job.command)
+	} else if err == nil {
+		b.forgetFailed(token)
+	}
+
+	if err != nil {
+		reply = b.echoCommand(job, reply)
+	}
+
+	replyCtx := ctx
+	if ctx.Err() != nil {
+		// Still tell the user, the reply has its own timeout
+		replyCtx = context.Background()
+	}
+
+	replyStart := time.Now()
+	b.queueReply(replyCtx, job, reply)
+	replyDuration := time.Since(replyStart)
+
+	total := time.Since(job.received)
+	b.sendTelemetry(telemetryEvent{
+		Time:         job.received,
+		Conversation: token,
+		Command:      job.command.Name,
+		Outcome:      commandOutcome(err),
+		LatencyMs:    webhookDuration.Milliseconds(),
+		TotalMs:      total.Milliseconds(),
+	})
+	log.Printf("[Timing]        Command %q took %s (webhook %s, reply %s)", job.richMessage.Message, total, webhookDuration, replyDuration)
+	if threshold := b.config.GetDuration("bot.slow_command_threshold"); threshold > 0 && total > threshold {
+		log.Printf("[Timing]        WARNING: Command %q was slower than %s", job.richMessage.Message, threshold)
+	}
+}
+
+// commandReply executes the command on the target and returns the reply
+// describing the outcome, along with the error of the target, if any.
+func (b *Bot) commandReply(ctx context.Context, job commandJob) (string, error) {
+	if err := b.validateArgs(job.command); err != nil {
+		log.Printf("[Talk]          Rejecting command %q: %s", job.richMessage.Message, err)
+		return "Error: " + err.Error(), err
+	}
+
+	if err := b.checkDomains(b.commandDomains(job.command)); err != nil {
+		log.Printf("[Talk]          Rejecting command %q: %s", job.richMessage.Message, err)
+		return "Error: " + err.Error(), err
+	}
+
+	result, err := b.target.Execute(ctx, job.command)
+	if err == nil && result.Fallback {
+		return b.successReply(job.command, result) + " (via fallback webhook)", nil
+	}
+	if ctx.Err() != nil {
+		log.Printf("[Talk]          Command %q exceeded bot.total_deadline", job.richMessage.Message)
+		return "Error: Home Assistant did not answer in time", ctx.Err()
+	} else if errors.Is(err, ErrTargetFailed) && result.Summary != "" {
+		return "Error calling Home Assistant: " + result.Summary, err
+	} else if errors.Is(err, ErrTargetFailed) {
+		return "Error calling Home Assistant", err
+	} else if err != nil {
+		log.Printf("[Talk]          Error executing command: %s", err)
+		return "Error: " + err.Error(), err
+	}
+
+	return b.successReply(job.command, result), nil
+}
+
+// successReply describes a successful result.
+func (b *Bot) successReply(command Command, result Result) string {
+	if result.Summary != "" {
+		return result.Summary
+	}
+
+	// Home Assistant may report targets which failed
+	if failed, found := failedTargets(result.Body, b.config.GetString("bot.ha.failed_field")); found && len(failed) > 0 {
+		return "Partially done, failed for: " + strings.Join(failed, ", ")
+	}
+
+	reply, rendered, err := b.renderResponse(command, result.Body)
+	if err != nil {
+		log.Printf("[Talk]          Error %s", err)
+	} else if rendered && reply != "" {
+		return reply
+	}
+
+	return b.getRandomResponse()
+}
+
+// echoCommand prefixes an error reply with the command which failed when
+// bot.echo_command_on_error is set, e.g. "Couldn't run '@ha open garage': ...".
+func (b *Bot) echoCommand(job commandJob, reply string) string {
+	if !b.config.GetBool("bot.echo_command_on_error") {
+		return reply
+	}
+
+	return fmt.Sprintf("Couldn't run '%s': %s", neutralizeText(richMessageToText(job.richMessage), maxEchoLength), reply)
+}
+
+// neutralizeText makes user input safe to repeat in a reply: it is shortened to
+// maxLength runes and put on one line, markdown is escaped and a zero-width
+// space after each @ keeps mentions like @all from notifying anyone.
+func neutralizeText(text string, maxLength int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxLength {
+		text = string(runes[:maxLength]) + "…"
+	}
+
+	var escaped strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '@':
+			escaped.WriteString("@\u200b")
+		case strings.ContainsRune("\\`*_~[]()#>|", r):
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+
+	return escaped.String()
+}
+
+// sendProcessingAck tells the user the command was received before Home
+// Assistant is called. The bot API has no typing indicator and bots can't edit
+// their messages, so this is a separate reply followed by the result.
+func (b *Bot) sendProcessingAck(ctx context.Context, job commandJob) {
+	b.sendReply(ctx, job.server, job.message, b.config.GetString("bot.ack_message"))
+}
@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNeutralizeText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"@ha open garage", "@\u200bha open garage"},
+		{"@ha notify @all", "@\u200bha notify @\u200ball"},
+		{"@ha say **bold** [link](http://x)", "@\u200bha say \\*\\*bold\\*\\* \\[link\\]\\(http://x\\)"},
+		{"@ha say\n# heading", "@\u200bha say \\# heading"},
+		{strings.Repeat("a", 120), strings.Repeat("a", 100) + "…"},
+	}
+	for _, test := range tests {
+		if got := neutralizeText(test.text, maxEchoLength); got != test.want {
+			t.Errorf("neutralizeText(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestEchoCommandDoesntMention(t *testing.T) {
+	b := newTestBot(t, map[string]any{"bot.echo_command_on_error": true})
+	job := commandJob{richMessage: RichObjectMessageWithParameters{
+		RichObjectMessage: RichObjectMessage{Message: "@ha notify @all {mention-user1}"},
+		Parameters: RichObjectParameters{
+			"mention-user1": {Id: "bob", Name: "Bob", Type: "user"},
+		},
+	}}
+
+	reply := b.echoCommand(job, "Error calling Home Assistant")
+	if strings.Contains(reply, "@all") || strings.Contains(reply, "@\"bob\"") {
+		t.Errorf("reply %q contains a mention", reply)
+	}
+	if !strings.HasPrefix(reply, "Couldn't run '") || !strings.HasSuffix(reply, "': Error calling Home Assistant") {
+		t.Errorf("reply = %q, want the command and the error", reply)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klatka/nc-ha_service_bot/bot"
+	"github.com/spf13/viper"
+)
+
+// runCommand runs a command line subcommand and returns the exit code.
+func runCommand(config *viper.Viper, name string, args []string) int {
+	switch name {
+	case "test":
+		return runTest(config, args)
+	case "replay":
+		return runReplay(config, args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintf(os.Stderr, "  %s\n        Start the bot\n", name)
+	fmt.Fprintf(os.Stderr, "  %s test <message>\n        Show what a chat message would send to Home Assistant\n", name)
+	fmt.Fprintf(os.Stderr, "  %s replay [-dry-run] <file>\n        Run requests captured to bot.capture_requests.path through the bot again\n", name)
+	fmt.Fprintf(os.Stderr, "  %s sign <secret> <random> <message>\n        Print the signature of a request body or reply\n", name)
+}
+
+// runSign prints the signature the bot computes for a message, which must match
+// the X-Nextcloud-Talk-Signature header Talk sends along with the random. It
+// needs no config, so it is run before the config is loaded.
+func runSign(args []string) int {
+	if len(args) != 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s sign <secret> <random> <message>\n", os.Args[0])
+		return 2
+	}
+
+	fmt.Println(bot.GenerateHmacForString(args[2], args[1], args[0]))
+	return 0
+}
+
+// runTest runs a chat message through the same trigger and payload code as the
+// server and prints the result without calling Home Assistant.
+func runTest(config *viper.Viper, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s test <message>\n", os.Args[0])
+		return 2
+	}
+
+	// The store is never used, so don't connect to Redis
+	b, err := bot.New(config, bot.WithStore(bot.NewMemoryStore()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	request, payload, err := b.Preview(args[0])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Request: %s %s\n", request.Method, request.URL)
+	if request.Method != "GET" {
+		fmt.Printf("Payload: %s\n", payload)
+	}
+	return 0
+}
+
+// dryRunTarget prints what a command would send to Home Assistant instead of
+// sending it. The preview is made by a second bot with the configured target.
+type dryRunTarget struct {
+	preview *bot.Bot
+}
+
+func (t dryRunTarget) Execute(_ context.Context, command bot.Command) (bot.Result, error) {
+	request, payload, err := t.preview.Preview(command.Text)
+	if err != nil {
+		return bot.Result{}, err
+	}
+
+	fmt.Printf("Would send: %s %s %s\n", request.Method, request.URL, payload)
+	return bot.Result{}, nil
+}
+
+// runReplay feeds captured requests to the handler of a bot, against Home
+// Assistant or with -dry-run without calling it. Replies are printed instead of
+// being posted to Talk.
+func runReplay(config *viper.Viper, args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print what would be sent to Home Assistant instead of sending it")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [-dry-run] <file>\n", os.Args[0])
+		return 2
+	}
+
+	requests, err := bot.ReadCapturedRequests(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	talk := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Printf("Reply: %s\n", body)
+	}))
+	defer talk.Close()
+
+	// All requests are queued at once, and must not be captured again
+	config.Set("bot.queue_size", len(requests))
+	config.Set("bot.capture_requests.path", "")
+	options := []bot.Option{bot.WithStore(bot.NewMemoryStore())}
+	if *dryRun {
+		preview, err := bot.New(config, bot.WithStore(bot.NewMemoryStore()))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		options = append(options, bot.WithTarget(dryRunTarget{preview: preview}), bot.WithDryRun())
+	}
+	b, err := bot.New(config, options...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	handler := b.Handler()
+	for i, captured := range requests {
+		request := captured.NewRequest(config)
+		request.Header.Set(config.GetString("bot.headers.backend"), talk.URL+"/")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		fmt.Printf("Request %d from %s: %d %s\n", i+1, captured.Time.Format("2006-01-02 15:04:05"), recorder.Code, strings.TrimSpace(recorder.Body.String()))
+	}
+	b.Drain()
+
+	return 0
+}
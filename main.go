@@ -19,306 +19,106 @@ package main
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/hex"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/klatka/nc-ha_service_bot/bot"
 	"github.com/spf13/viper"
 )
 
-var (
-	config            *viper.Viper
-	errInvalidBody    = errors.New("Invalid body supplied")
-	letterBytes       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	possibleResponses = []string{
-		"Done!",
-	}
-	triggerMessageRegex = regexp.MustCompile("^@ha\\s\\w+\\s\\w+")
-)
-
-type MessageActor struct {
-	Type string `json:"type"`
-	Id   string `json:"id"`
-	Name string `json:"name"`
-}
-
-type MessageObject struct {
-	Type      string `json:"type"`
-	Id        string `json:"id"`
-	Name      string `json:"name"`
-	Content   string `json:"content"`
-	MediaType string `json:"mediaType"`
-}
-
-type MessageTarget struct {
-	Type string `json:"type"`
-	Id   string `json:"id"`
-	Name string `json:"name"`
-}
-
-type Message struct {
-	Type   string        `json:"type"`
-	Actor  MessageActor  `json:"actor"`
-	Object MessageObject `json:"object"`
-	Target MessageTarget `json:"target"`
-}
-
-type Response struct {
-	Message string `json:"message"`
-	ReplyTo string `json:"replyTo"`
-}
-
-type RichObjectParameter struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
-}
-
-type RichObjectMessage struct {
-	Message string `json:"message"`
-}
-
-type RichObjectMessageWithParameters struct {
-	RichObjectMessage
-	Parameters map[string]RichObjectParameter `json:"parameters,omitempty"`
-}
-
-func createMessage(input string) (Message, error) {
-	var message Message
-	reader := strings.NewReader(input)
-	decoder := json.NewDecoder(reader)
-	err := decoder.Decode(&message)
-	if err != nil {
-		return message, errInvalidBody
-	}
-
-	return message, nil
-}
-
-func createRichMessage(input string) (RichObjectMessageWithParameters, error) {
-	var message RichObjectMessageWithParameters
-	reader := strings.NewReader(input)
-	decoder := json.NewDecoder(reader)
-	err := decoder.Decode(&message)
-	if err != nil {
-		return message, errInvalidBody
-	}
-
-	return message, nil
-}
-
-func createRichMessageWithoutParameters(input string) (RichObjectMessage, error) {
-	var message RichObjectMessage
-	reader := strings.NewReader(input)
-	decoder := json.NewDecoder(reader)
-	err := decoder.Decode(&message)
-	if err != nil {
-		return message, errInvalidBody
-	}
-
-	return message, nil
-}
-
-func generateRandomBytes(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+// setupLogOutput points the standard logger to stdout, stderr, syslog or
+// a file which is opened in append mode.
+func setupLogOutput(output string) error {
+	switch output {
+	case "", "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "syslog":
+		writer, err := newSyslogWriter()
+		if err != nil {
+			return err
+		}
+		// Syslog adds its own timestamps
+		log.SetFlags(0)
+		log.SetOutput(writer)
+	default:
+		file, err := os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(file)
 	}
-	return string(b)
-}
-
-func getRandomResponse() string {
-	return possibleResponses[rand.Intn(len(possibleResponses))]
-}
 
-func generateHmacForString(message string, random string, secret string) string {
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(random + message))
-	sum := h.Sum(nil)
-	return hex.EncodeToString(sum)
+	return nil
 }
 
-func sendReply(server string, message Message, responseText string) {
-	random := generateRandomBytes(64)
-	signature := generateHmacForString(responseText, random, config.GetString("bot.secret"))
-
-	// Send actual message
-	response := Response{
-		Message: responseText,
-		ReplyTo: message.Object.Id,
-	}
-	responseBody, _ := json.Marshal(response)
-	bodyReader := bytes.NewReader(responseBody)
+// loadConfig reads the config from NCBOT_CONFIG or config.yaml.
+func loadConfig() (*viper.Viper, error) {
+	config := viper.New()
+	bot.SetDefaults(config)
 
-	requestURL := fmt.Sprintf("%socs/v2.php/apps/spreed/api/v1/bot/%s/message", server, message.Target.Id)
-	request, err := http.NewRequest("POST", requestURL, bodyReader)
-	if err != nil {
-		log.Printf("[Response]      Error creating request %v", err)
-		os.Exit(1)
-	}
+	// Single settings can be overridden with e.g. NCBOT_BOT_PORT
+	config.SetEnvPrefix("NCBOT")
+	config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	config.AutomaticEnv()
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("OCS-APIRequest", "true")
-	request.Header.Set("X-Nextcloud-Talk-Bot-Random", random)
-	request.Header.Set("X-Nextcloud-Talk-Bot-Signature", signature)
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := http.Client{
-		Timeout:   30 * time.Second,
-		Transport: transport,
+	if inline := os.Getenv("NCBOT_CONFIG"); inline != "" {
+		// YAML is a superset of JSON, so both can be read
+		config.SetConfigType("yaml")
+		if err := config.ReadConfig(bytes.NewBufferString(inline)); err != nil {
+			return nil, fmt.Errorf("NCBOT_CONFIG: %w", err)
+		}
+	} else {
+		config.SetConfigName("config")
+		config.AddConfigPath(".")
+		if err := config.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
 	}
 
-	_, err = client.Do(request)
-	if err != nil {
-		log.Printf("[Response]      Error posting request %v", err)
-		return
-	}
+	return config, nil
 }
 
-func messageHandling(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		// Only post allowed
-		return
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(runSign(os.Args[2:]))
 	}
 
-	body, err := io.ReadAll(r.Body)
+	config, err := loadConfig()
 	if err != nil {
-		log.Printf("[Request]       Error reading body: %v", err)
-		http.Error(w, "can't read body", http.StatusBadRequest)
+		log.Fatalf("Fatal error %s \n", err)
 		return
 	}
 
-	server := r.Header.Get("X-NEXTCLOUD-TALK-BACKEND")
-	random := r.Header.Get("X-NEXTCLOUD-TALK-RANDOM")
-	signature := r.Header.Get("X-NEXTCLOUD-TALK-SIGNATURE")
-	digest := generateHmacForString(string(body), random, config.GetString("bot.secret"))
-
-	if digest != signature {
-		log.Printf("[Request]       Error validating signature: %s / %s", digest, signature)
-		http.Error(w, "Invalid signature", http.StatusBadRequest)
-		return
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(config, os.Args[1], os.Args[2:]))
 	}
 
-	message, err := createMessage(string(body))
-
-	if err != nil {
-		log.Printf("[Request]       Error invalid body: %s", err)
-		http.Error(w, "Invalid signature", http.StatusBadRequest)
+	if err := setupLogOutput(config.GetString("bot.log.output")); err != nil {
+		log.Fatalf("Fatal error log output: %s \n", err)
 		return
 	}
-
-	if message.Object.Name == "message" {
-		richMessage, err := createRichMessageWithoutParameters(message.Object.Content)
-		if err == nil {
-			if triggerMessageRegex.Match([]byte(richMessage.Message)) {
-				log.Printf("[Talk]          Command found: %s", richMessage.Message)
-
-				// Format data
-				json := commandToJson(richMessage.Message)
-
-				// Call Home Assistant endpoint
-				if callWebhook(json) {
-					sendReply(server, message, getRandomResponse())
-				} else {
-					sendReply(server, message, "Error calling Home Assistant")
-				}
-
-			} else {
-				log.Printf("[Talk]          Message is not command: %s", richMessage.Message)
-			}
-		}
-	}
-
-	http.Error(w, "Received", http.StatusOK)
-}
-
-func callWebhook(jsonData []byte) bool {
-	// Remove trailing slashes from ha_url
-	cleanedURL := strings.TrimRight(config.GetString("bot.ha.url"), "/")
-
-	// Build the request URL
-	url := cleanedURL + "/api/webhook/" + config.GetString("bot.ha.webhook_id")
-
-	// Send the POST request with the JSON data
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("[Webhook]       POST request failed: %s", err)
-		return false
-	}
-	defer resp.Body.Close()
-
-	// Check the response
-	if resp.StatusCode == http.StatusOK {
-		log.Println("[Webhook]       POST request was successful!")
-		// You can read the response body if needed
-		// responseBody, _ := ioutil.ReadAll(resp.Body)
-		// fmt.Println("Response content:", string(responseBody))
-
-		return true
+	if os.Getenv("NCBOT_CONFIG") != "" {
+		log.Println("[Config]        Loaded from NCBOT_CONFIG")
 	} else {
-		log.Printf("[Webhook]       POST request failed with status code: %s", strconv.Itoa(resp.StatusCode))
-		// You can read the response body if needed
-		// responseBody, _ := ioutil.ReadAll(resp.Body)
-		// fmt.Println("Response content:", string(responseBody))
+		log.Println("[Config]        File loaded")
 	}
 
-	return false
-}
-
-func commandToJson(command string) []byte {
-	// Split the string into words using whitespace as the delimiter
-	words := strings.Fields(command)
-
-	// Check if there are at least two words in the slice
-	if len(words) >= 3 {
-		// Define the JSON data with the variables
-		jsonStr := []byte(fmt.Sprintf(`{
-			"action": "%s",
-			"target": "%s"
-		}`, words[1], words[2]))
-
-		return jsonStr
-	} else {
-		log.Println("[Talk]          Command doesn't contain at least two words.")
-	}
-
-	return nil
-}
-
-func main() {
-	config = viper.New()
-	config.SetConfigName("config")
-	config.AddConfigPath(".")
-	if err := config.ReadInConfig(); err != nil {
-		log.Fatalf("Fatal error config file: %s \n", err)
+	b, err := bot.New(config)
+	if err != nil {
+		log.Fatalf("Fatal error %s \n", err)
 		return
 	}
-	log.Println("[Config]        File loaded")
-
-	// Create a mux for routing incoming requests
-	m := http.NewServeMux()
-
-	// All URLs will be handled by this function
-	m.HandleFunc("/message", messageHandling)
+	b.LogSummary()
 
 	s := &http.Server{
-		Addr:    ":" + config.GetString("bot.port"),
-		Handler: m,
+		Addr:    ":" + strconv.Itoa(config.GetInt("bot.port")),
+		Handler: b.Handler(),
 	}
 
 	log.Printf("[Network]       Listening on port %d", config.GetInt("bot.port"))